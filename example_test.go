@@ -0,0 +1,88 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package fprot Golang F-Prot client
+Fprot - Golang F-Prot client
+*/
+package fprot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+)
+
+func ExampleClient_ScanReader() {
+	address, stop, err := mockScanServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stop()
+
+	c, err := NewClient(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+
+	s, err := c.ScanReader(ctx, bytes.NewReader([]byte(eicarVirus)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, rs := range s {
+		fmt.Println(rs.Infected, rs.Signature)
+	}
+	// Output: true EICAR_Test_File
+}
+
+func ExampleClient_ScanFile() {
+	address, stop, err := mockScanServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stop()
+
+	c, err := NewClient(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+
+	s, err := c.ScanFile(ctx, path.Join("examples", "data", "eicar.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, rs := range s {
+		fmt.Println(rs.Filename, rs.Status, rs.Signature)
+	}
+	// Output: examples/data/eicar.txt infected EICAR_Test_File
+}
+
+func ExampleClient_Info() {
+	address, stop, err := mockScanServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stop()
+
+	c, err := NewClient(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+
+	i, err := c.Info(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(i.Version, i.Engine, i.Protocol)
+	// Output: 6.2.3 4.6.5 4.6
+}
@@ -10,30 +10,80 @@ Fprot - Golang F-Prot client
 package fprot
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"net/textproto"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	defaultTimeout    = 15 * time.Second
-	defaultSleep      = 1 * time.Second
-	defaultCmdTimeout = 1 * time.Minute
-	chunkSize         = 1024
-	genericErr        = "ERROR: %s"
-	invalidRespErr    = "Invalid server response: %s"
-	pathNotDirErr     = "The path: %s is not a directory"
-	noSizeErr         = "The content length could not be determined"
+	defaultKeepAlive    = 30 * time.Second
+	defaultMaxInMemory  = 1024 * 1024
+	minChunkSize        = 512
+	defaultReadBufSize  = 4096
+	minReadBufSize      = 512
+	defaultWriteBufSize = 4096
+	aliveWait           = time.Millisecond
+	aliveIdle           = 100 * time.Millisecond
+	minWriteBufSize     = 512
+	genericErr          = "ERROR: %s"
+	invalidRespErr      = "Invalid server response: %s"
+	invalidBannerErr    = "Invalid server banner: %q"
+	pathNotDirErr       = "The path: %s is not a directory"
+	invalidAddrErr      = "The supplied address is invalid"
+	unixPrefix          = "unix:"
+	statusSep           = ", "
+	signatureSep        = ","
+	archiveSep          = "->"
+	walkErr             = "Some paths could not be read: %s"
+	oversizeStatus      = "skipped: exceeds the maximum file size"
+	unreadableStatus    = "skipped: permission denied"
+	missingStatus       = "skipped: no response from the server"
+	invalidNameErr      = "Invalid stream name: %q"
+	invalidCmdErr       = "Invalid command: %q"
+	streamName          = "stream"
+	invalidSizeErr      = "The content length: %d is invalid"
+	shortStreamErr      = "The stream ended after %d of the declared %d bytes"
+	streamRejectedErr   = "The server rejected the stream: %s"
+	selfTestErr         = "The EICAR test string was not detected: %s"
+	archiveFormatErr    = "Unsupported archive format: %q"
+	connClosedErr       = "The supplied connection has been closed"
+	eicarTest           = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+)
+
+const (
+	// DefaultConnTimeout is the default connection timeout
+	DefaultConnTimeout = 15 * time.Second
+	// DefaultConnSleep is the default time to wait between retries
+	DefaultConnSleep = 1 * time.Second
+	// DefaultCmdTimeout is the default command timeout
+	DefaultCmdTimeout = 1 * time.Minute
+	// DefaultChunkSize is the default size of the chunks in
+	// which streams are sent to the server
+	DefaultChunkSize = 1024
 )
 
 const (
@@ -53,8 +103,16 @@ const (
 	InternalError StatusCode = 32
 	// SkipError 64 Atleast one object was not scanned
 	SkipError StatusCode = 64
-	// DisinfectError 128 Atleast one object was disinfected
+	// DisinfectError 128 Atleast one object was disinfected.
+	// The fpscand protocol has no disinfect command, the bit
+	// is only set by servers configured to disinfect
 	DisinfectError StatusCode = 128
+
+	allStatusCodes = Infected | HeuristicMatch | UserError | RestrictionError |
+		SystemError | InternalError | SkipError | DisinfectError
+	errorStatusCodes = UserError | RestrictionError | SystemError |
+		InternalError | SkipError | DisinfectError
+	infectedStatusCodes = Infected | DisinfectError | HeuristicMatch
 )
 
 const (
@@ -72,6 +130,32 @@ const (
 	Quit
 )
 
+var (
+	statusFlags = []struct {
+		code StatusCode
+		desc string
+	}{
+		{Infected, "Atleast one virus-infected object was found"},
+		{HeuristicMatch, "Atleast one suspicious (heuristic match) object was found"},
+		{UserError, "Scanning interrupted by user"},
+		{RestrictionError, "Scan restriction caused scan to skip files"},
+		{SystemError, "Platform error"},
+		{InternalError, "Internal Engine error"},
+		{SkipError, "Atleast one object was not scanned"},
+		{DisinfectError, "Atleast one object was disinfected"},
+	}
+)
+
+var (
+	// bufPool holds the buffers used to stream content
+	bufPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, DefaultChunkSize)
+			return &b
+		},
+	}
+)
+
 var (
 	// ZeroTime holds the zero value of time
 	ZeroTime   time.Time
@@ -87,31 +171,40 @@ type readerWithLen interface {
 type StatusCode int
 
 func (c StatusCode) String() (s string) {
-	switch c {
-	case NoMatch:
+	if c == NoMatch {
 		s = "No signature was matched"
-	case Infected:
-		s = "Atleast one virus-infected object was found"
-	case HeuristicMatch:
-		s = "Atleast one suspicious (heuristic match) object was found"
-	case UserError:
-		s = "Scanning interrupted by user"
-	case RestrictionError:
-		s = "Scan restriction caused scan to skip files"
-	case SystemError:
-		s = "Platform error"
-	case InternalError:
-		s = "Internal Engine error"
-	case SkipError:
-		s = "Atleast one object was not scanned"
-	case DisinfectError:
-		s = "Atleast one object was disinfected"
-	default:
-		s = ""
+		return
+	}
+
+	if c&^allStatusCodes != 0 {
+		return
+	}
+
+	var n []string
+	for _, f := range statusFlags {
+		if c.Has(f.code) {
+			n = append(n, f.desc)
+		}
 	}
+	s = strings.Join(n, statusSep)
+
 	return
 }
 
+// MarshalText returns the description of the status code
+func (c StatusCode) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// Has returns true if the flag is set on the status code,
+// NoMatch has no bits and is only held by a clean status code
+func (c StatusCode) Has(flag StatusCode) bool {
+	if flag == NoMatch {
+		return c == NoMatch
+	}
+	return c&flag == flag
+}
+
 // A Command represents a Fprot Command
 type Command int
 
@@ -133,6 +226,11 @@ func (c Command) String() (s string) {
 	return
 }
 
+// MarshalText returns the name of the command
+func (c Command) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
 // Info is the server information
 type Info struct {
 	Version   string
@@ -140,38 +238,307 @@ type Info struct {
 	Protocol  string
 	Signature string
 	Uptime    string
+	Raw       string
 }
 
 // Response is the response from the server
 type Response struct {
-	Filename    string
-	ArchiveItem string
-	Signature   string
-	Status      string
-	StatusCode  StatusCode
-	Infected    bool
-	Raw         string
+	Filename    string        `json:"filename"`
+	ArchiveItem string        `json:"archive_item,omitempty"`
+	ArchivePath []string      `json:"archive_path,omitempty"`
+	Signature   string        `json:"signature,omitempty"`
+	Signatures  []string      `json:"signatures,omitempty"`
+	Status      string        `json:"status"`
+	StatusCode  StatusCode    `json:"status_code"`
+	Infected    bool          `json:"infected"`
+	Raw         string        `json:"raw"`
+	Duration    time.Duration `json:"duration"`
+	Bytes       int64         `json:"bytes,omitempty"`
+}
+
+// MarshalJSON returns the JSON encoding of the response which
+// includes the description of the status code, the status code
+// itself is kept numeric
+func (r Response) MarshalJSON() ([]byte, error) {
+	type response Response
+	return json.Marshal(struct {
+		response
+		StatusCode        int    `json:"status_code"`
+		StatusDescription string `json:"status_description"`
+	}{
+		response:          response(r),
+		StatusCode:        int(r.StatusCode),
+		StatusDescription: r.StatusDescription(),
+	})
+}
+
+// StatusDescription returns the description of the status code,
+// the status sent by the server is returned for codes that have
+// no description
+func (r *Response) StatusDescription() (s string) {
+	if s = r.StatusCode.String(); s == "" {
+		s = r.Status
+	}
+	return
+}
+
+// IsClean returns true if no signature was matched
+func (r *Response) IsClean() bool {
+	return r.StatusCode == NoMatch
+}
+
+// HasError returns true if any of the error status bits are set
+func (r *Response) HasError() bool {
+	return r.StatusCode&errorStatusCodes != 0
+}
+
+// Stats holds the counters of a client
+type Stats struct {
+	// Scans is the number of scan results received
+	Scans uint64
+	// Infected is the number of infected results
+	Infected uint64
+	// Errors is the number of results with an error status
+	Errors uint64
+	// Bytes is the number of bytes streamed to the server
+	Bytes uint64
+}
+
+// Summary holds the counts of the responses of a scan, the
+// counts follow the status code bits of each response and
+// Infected follows Response.Infected
+type Summary struct {
+	// Scanned is the number of responses received
+	Scanned int `json:"scanned"`
+	// Clean is the number of responses without a match
+	Clean int `json:"clean"`
+	// Infected is the number of responses with an infected status
+	Infected int `json:"infected"`
+	// Errors is the number of responses with an error status
+	// other than SkipError
+	Errors int `json:"errors"`
+	// Skipped is the number of responses with the SkipError status
+	Skipped int `json:"skipped"`
+}
+
+func (s *Summary) add(rs *Response) {
+	s.Scanned++
+	if rs.IsClean() {
+		s.Clean++
+	}
+	if rs.Infected {
+		s.Infected++
+	}
+	if rs.StatusCode&(errorStatusCodes&^SkipError) != 0 {
+		s.Errors++
+	}
+	if rs.StatusCode&SkipError != 0 {
+		s.Skipped++
+	}
+}
+
+// ClientConfig holds the configuration of a client
+type ClientConfig struct {
+	// Address is the address of the server
+	Address string
+	// Network is the network used to connect, tcp or unix
+	Network string
+	// ConnTimeout is the connection timeout
+	ConnTimeout time.Duration
+	// ConnRetries is the number of times a failed connection
+	// or command is retried
+	ConnRetries int
+	// ConnSleep is the time to wait between retries
+	ConnSleep time.Duration
+	// TotalDialTimeout is the maximum duration of connecting
+	// including the retries
+	TotalDialTimeout time.Duration
+	// CmdTimeout is the command timeout
+	CmdTimeout time.Duration
+	// StreamTimeout is the timeout of each write of a stream
+	StreamTimeout time.Duration
+	// ScanTimeout is the maximum duration of a scan
+	ScanTimeout time.Duration
+	// IdleTimeout is the time after which an idle connection
+	// is closed
+	IdleTimeout time.Duration
+}
+
+// ContextDialer is the interface used to establish connections
+// to the server, it is implemented by net.Dialer
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Logger is the interface used to log the commands sent to
+// and the responses received from the server
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, args ...interface{}) {}
+
+// ScanError is returned when the server reports an error
+// status while scanning a file
+type ScanError struct {
+	Code     StatusCode
+	Status   string
+	Filename string
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf(genericErr, e.Status)
+}
+
+// BannerError is returned by Info when the banner sent by the
+// server could not be parsed, Raw holds all the banner lines
+type BannerError struct {
+	Raw string
+}
+
+func (e *BannerError) Error() string {
+	return fmt.Sprintf(invalidBannerErr, e.Raw)
+}
+
+// WalkError is returned when some paths could not be read
+// while walking a directory, the readable files are still
+// scanned. Err holds the ScanError of the readable files if
+// the server reported an error status for one of them
+type WalkError struct {
+	Errors []error
+	Err    *ScanError
+}
+
+func (e *WalkError) Error() string {
+	n := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		n[i] = err.Error()
+	}
+	return fmt.Sprintf(walkErr, strings.Join(n, "; "))
+}
+
+// Unwrap returns the ScanError of the readable files
+func (e *WalkError) Unwrap() error {
+	if e.Err == nil {
+		return nil
+	}
+	return e.Err
+}
+
+// walkError returns the error of a scan that walked directories,
+// the walk errors are returned along with the ScanError of the
+// scan, other errors of the scan take precedence
+func walkError(err, werr error) error {
+	we, ok := werr.(*WalkError)
+	if !ok {
+		return err
+	}
+
+	se, ok := err.(*ScanError)
+	if err != nil && !ok {
+		return err
+	}
+
+	return &WalkError{Errors: we.Errors, Err: se}
 }
 
 // A Client represents a Fprot client.
+// A Client is safe for concurrent use, commands are serialized
+// over its single connection. Use a Pool to run scans in parallel.
+// The Set methods are not synchronized, they must be called before
+// the client is used or shared, NewClientWithOptions configures a
+// client at creation.
+// The scan methods return every response that was received even
+// when an error is returned, the responses are complete only if
+// the error is nil or a ScanError
 type Client struct {
-	address     string
-	connTimeout time.Duration
-	connRetries int
-	connSleep   time.Duration
-	cmdTimeout  time.Duration
-	tc          *textproto.Conn
-	m           sync.Mutex
-	conn        net.Conn
+	// stats is kept first to ensure the 64 bit alignment
+	// required by the atomic operations
+	stats Stats
+	settings
+	tc       *textproto.Conn
+	m        sync.Mutex
+	cmdMu    sync.Mutex
+	conn     net.Conn
+	streamed bool
+	protocol string
+	active   int
+	lastUsed time.Time
+	reaper   *time.Timer
+	// streamNames maps the escaped names of the streams
+	// of the current command to the original names
+	streamNames map[string]string
+}
+
+// settings holds the client configuration, it is kept apart
+// from the connection state so it can be copied to the new
+// clients used for parallel scans
+type settings struct {
+	address            string
+	network            string
+	connTimeout        time.Duration
+	connRetries        int
+	connSleep          time.Duration
+	cmdTimeout         time.Duration
+	tlsConfig          *tls.Config
+	maxInMemory        int64
+	listOpts           listOptions
+	maxFileSize        int64
+	streamChunkSize    int
+	logger             Logger
+	resultHook         func(*Response)
+	dialer             ContextDialer
+	keepAlive          time.Duration
+	idleTimeout        time.Duration
+	contentLength      func(io.Reader) (int64, bool)
+	readBufSize        int
+	writeBufSize       int
+	queueBatchSize     int
+	sem                chan struct{}
+	retryableErrors    func(error) bool
+	backoffBase        time.Duration
+	backoffMax         time.Duration
+	backoffFactor      float64
+	scanTimeout        time.Duration
+	localAddr          net.Addr
+	responseRe         *regexp.Regexp
+	onReconnect        func(int, error)
+	streamTimeout      time.Duration
+	signatureTransform func(string) string
+	heuristicsClean    bool
+	totalDialTimeout   time.Duration
 }
 
-// SetConnTimeout sets the connection timeout
+// SetConnTimeout sets the connection timeout, it applies to
+// each connection attempt so with retries connecting may take
+// upto the timeout times the number of attempts plus the sleeps
+// between them. SetTotalDialTimeout bounds the whole sequence
 func (c *Client) SetConnTimeout(t time.Duration) {
 	if t > 0 {
 		c.connTimeout = t
 	}
 }
 
+// SetKeepAlivePeriod sets the TCP keep-alive period of the
+// connection, a negative value disables keep-alives
+func (c *Client) SetKeepAlivePeriod(t time.Duration) {
+	if t != 0 {
+		c.keepAlive = t
+	}
+}
+
+// SetScanTimeout sets the maximum duration of a scan of several
+// files, the remaining files are not scanned once it elapses and
+// the responses received are returned with the context error.
+// The default of 0 means there is no limit
+func (c *Client) SetScanTimeout(t time.Duration) {
+	if t >= 0 {
+		c.scanTimeout = t
+	}
+}
+
 // SetCmdTimeout sets the cmd timeout
 func (c *Client) SetCmdTimeout(t time.Duration) {
 	if t > 0 {
@@ -179,8 +546,32 @@ func (c *Client) SetCmdTimeout(t time.Duration) {
 	}
 }
 
+// SetStreamTimeout sets the maximum duration of each write while
+// the content of a stream is sent. The connection timeout bounds
+// connecting to the server and the command timeout bounds each
+// command and each response line. If a stream timeout is set it
+// replaces the command timeout while the content is sent so that
+// large streams that make progress are not cut off. The default
+// of 0 applies the command timeout to the whole stream
+func (c *Client) SetStreamTimeout(t time.Duration) {
+	if t >= 0 {
+		c.streamTimeout = t
+	}
+}
+
+// SetTotalDialTimeout sets the maximum duration of connecting
+// to the server including the retries and the sleeps between
+// them. The default of 0 means there is no limit beyond the
+// connection timeout of each attempt
+func (c *Client) SetTotalDialTimeout(t time.Duration) {
+	if t >= 0 {
+		c.totalDialTimeout = t
+	}
+}
+
 // SetConnRetries sets the number of times
-// connection is retried
+// connection is retried, commands that fail due
+// to a broken connection are retried as well
 func (c *Client) SetConnRetries(s int) {
 	if s < 0 {
 		s = 0
@@ -188,221 +579,1663 @@ func (c *Client) SetConnRetries(s int) {
 	c.connRetries = s
 }
 
-// SetConnSleep sets the connection retry sleep
-// duration in seconds
-func (c *Client) SetConnSleep(s time.Duration) {
-	if s > 0 {
-		c.connSleep = s
+// SetDialNetwork sets the network used to connect to
+// the server, one of tcp, tcp4, tcp6 or unix
+func (c *Client) SetDialNetwork(n string) {
+	switch n {
+	case "tcp", "tcp4", "tcp6", "unix":
+		c.network = n
 	}
 }
 
-// Info returns server information
-func (c *Client) Info(ctx context.Context) (i Info, err error) {
-	var s string
-	if s, err = c.basicCmd(ctx, Help); err != nil {
-		return
+// SetTLSConfig sets the TLS configuration used to
+// connect to a TLS enabled server, nil disables TLS
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.tlsConfig = cfg
+}
+
+// SetMaxInMemory sets the maximum number of bytes of a
+// reader of unknown length that are buffered in memory,
+// larger content is buffered to a temporary file
+func (c *Client) SetMaxInMemory(n int64) {
+	if n > 0 {
+		c.maxInMemory = n
 	}
+}
 
-	ms := helpRe.FindStringSubmatch(s)
-	if ms == nil {
-		err = fmt.Errorf(invalidRespErr, s)
-		return
+// SetFollowSymlinks sets whether symlinks are followed when
+// scanning directories, when enabled the targets are scanned
+// and each real path is only scanned once. Symlinks are
+// skipped when disabled which is the default
+func (c *Client) SetFollowSymlinks(b bool) {
+	ListFollowSymlinks(b)(&c.listOpts)
+}
+
+// SetSkipUnreadable sets whether files and directories that
+// can not be read due to their permissions are skipped when
+// scanning directories, a response with the SkipError status
+// code is returned for each of them instead of a WalkError
+func (c *Client) SetSkipUnreadable(b bool) {
+	ListSkipUnreadable(b)(&c.listOpts)
+}
+
+// SetMaxDepth sets how deep directory scans descend, 0 only
+// scans the files in the top directory and a negative value
+// which is the default means there is no limit
+func (c *Client) SetMaxDepth(n int) {
+	ListMaxDepth(n)(&c.listOpts)
+}
+
+// SetExcludeGlobs sets the patterns of the paths to skip when
+// scanning directories. Patterns use the filepath.Match syntax
+// and are matched against the path relative to the directory
+// being scanned, patterns without a separator are also matched
+// against the base name. Directories that match are not walked
+// and invalid patterns are ignored
+func (c *Client) SetExcludeGlobs(globs []string) {
+	ListExcludeGlobs(globs)(&c.listOpts)
+}
+
+// SetIncludeExtensions sets the file extensions to scan when
+// scanning directories, matching is case insensitive and an
+// empty list scans all files
+func (c *Client) SetIncludeExtensions(exts []string) {
+	ListIncludeExtensions(exts)(&c.listOpts)
+}
+
+// SetExcludeExtensions sets the file extensions to skip when
+// scanning directories, matching is case insensitive
+func (c *Client) SetExcludeExtensions(exts []string) {
+	ListExcludeExtensions(exts)(&c.listOpts)
+}
+
+// SetMaxFileSize sets the size in bytes above which files are
+// not submitted for scanning, a response with the SkipError
+// status code is returned for each skipped file. The default
+// of 0 means there is no limit
+func (c *Client) SetMaxFileSize(n int64) {
+	if n < 0 {
+		n = 0
 	}
+	c.maxFileSize = n
+}
 
-	i = Info{
-		Version:   string(ms[1]),
-		Engine:    string(ms[2]),
-		Protocol:  string(ms[3]),
-		Signature: string(ms[4]),
-		Uptime:    string(ms[5]),
+// SetStreamChunkSize sets the size of the chunks in which
+// streams are sent to the server, the minimum is 512 bytes
+// and the default DefaultChunkSize
+func (c *Client) SetStreamChunkSize(n int) {
+	if n >= minChunkSize {
+		c.streamChunkSize = n
 	}
-	return
 }
 
-// Close closes the server connection
-func (c *Client) Close(ctx context.Context) (err error) {
-	_, err = c.basicCmd(ctx, Quit)
+// SetLogger sets the logger used to log the commands sent
+// and the responses received, nil disables logging
+func (c *Client) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	c.logger = l
+}
 
-	c.tc.Close()
+// SetResultHook sets a function that is called with every
+// response parsed from the server regardless of its status.
+// The hook runs while the connection is held, it must not use
+// the client
+func (c *Client) SetResultHook(fn func(*Response)) {
+	c.resultHook = fn
+}
 
-	return
+// SetHeuristicsInfected sets whether responses with only the
+// HeuristicMatch status bit are marked as infected, the default
+// is true. The status code is reported unchanged either way
+func (c *Client) SetHeuristicsInfected(b bool) {
+	c.heuristicsClean = !b
 }
 
-// ScanFile submits a single file for scanning
-func (c *Client) ScanFile(ctx context.Context, f string) (r []*Response, err error) {
-	r, err = c.fileCmd(ctx, ScanFile, f)
-	return
+// infectedMask returns the status bits that mark a response
+// as infected
+func (c *Client) infectedMask() StatusCode {
+	if c.heuristicsClean {
+		return infectedStatusCodes &^ HeuristicMatch
+	}
+
+	return infectedStatusCodes
 }
 
-// ScanFiles submits multiple files for scanning
-func (c *Client) ScanFiles(ctx context.Context, f ...string) (r []*Response, err error) {
-	r, err = c.fileCmd(ctx, ScanFile, f...)
-	return
+// SetSignatureTransform sets a function that is applied to each
+// signature name as responses are parsed, for example to strip
+// engine specific prefixes. Response.Raw keeps the signature
+// sent by the server
+func (c *Client) SetSignatureTransform(fn func(string) string) {
+	c.signatureTransform = fn
 }
 
-// ScanStream submits a stream for scanning
-func (c *Client) ScanStream(ctx context.Context, f ...string) (r []*Response, err error) {
-	r, err = c.fileCmd(ctx, ScanStream, f...)
-	return
+// SetOnReconnect sets a function that is called each time a
+// command is retried over a new connection after the previous
+// one failed, with the retry attempt and the error that caused
+// it. fn is called once the command has completed so it may
+// use the client
+func (c *Client) SetOnReconnect(fn func(attempt int, err error)) {
+	c.onReconnect = fn
 }
 
-// ScanReader submits an io reader via a stream for scanning
-func (c *Client) ScanReader(ctx context.Context, i io.Reader) (r []*Response, err error) {
-	r, err = c.readerCmd(ctx, i)
-	return
+// SetDialer sets the dialer used to connect to the server, the
+// connection timeout is applied if a net.Dialer without a timeout
+// is supplied. TLS if configured is layered over the connection
+func (c *Client) SetDialer(d ContextDialer) {
+	c.dialer = d
 }
 
-// ScanDir submits a directory for scanning
-func (c *Client) ScanDir(ctx context.Context, d string) (r []*Response, err error) {
-	var fl []string
+// SetBackoff sets an exponential backoff between retries used
+// instead of the connection retry sleep, the backoff starts at
+// base and grows by factor upto max with random jitter. A zero
+// base restores the fixed connection retry sleep
+func (c *Client) SetBackoff(base, max time.Duration, factor float64) {
+	if base == 0 {
+		c.backoffBase = 0
+		return
+	}
 
-	if fl, err = getFiles(d); err != nil {
+	if base < 0 || max < base || factor < 1 {
 		return
 	}
 
-	r, err = c.fileCmd(ctx, ScanFile, fl...)
-	return
+	c.backoffBase = base
+	c.backoffMax = max
+	c.backoffFactor = factor
 }
 
-// ScanDirStream submits a directory for scanning as streams
-func (c *Client) ScanDirStream(ctx context.Context, d string) (r []*Response, err error) {
-	var fl []string
+// SetLocalAddr sets the local address connections to the server
+// originate from, it is not used by custom dialers other than a
+// net.Dialer without a local address
+func (c *Client) SetLocalAddr(addr net.Addr) {
+	c.localAddr = addr
+}
 
-	if fl, err = getFiles(d); err != nil {
-		return
+// SetResponsePattern sets the regular expression used to parse
+// the response lines of servers that use a different format. The
+// named groups statuscode, status and filename are required while
+// signature and aname, the archive member path, are optional.
+// Patterns without the required groups are ignored and nil
+// restores the built in pattern
+func (c *Client) SetResponsePattern(re *regexp.Regexp) {
+	if re != nil {
+		for _, name := range []string{"statuscode", "status", "filename"} {
+			if re.SubexpIndex(name) < 0 {
+				return
+			}
+		}
 	}
 
-	r, err = c.fileCmd(ctx, ScanStream, fl...)
-	return
+	c.responseRe = re
 }
 
-func (c *Client) dial(ctx context.Context) (conn net.Conn, err error) {
-	d := &net.Dialer{
-		Timeout: c.connTimeout,
-	}
+// SetRetryableErrors sets a function that reports whether a dial
+// error is retried, timeouts and refused or reset connections
+// are always retried
+func (c *Client) SetRetryableErrors(fn func(error) bool) {
+	c.retryableErrors = fn
+}
 
-	for i := 0; i <= c.connRetries; i++ {
-		conn, err = d.Dial("tcp4", c.address)
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			time.Sleep(c.connSleep)
-			continue
-		}
-		break
+// SetConnSleep sets the connection retry sleep
+// duration in seconds
+func (c *Client) SetConnSleep(s time.Duration) {
+	if s > 0 {
+		c.connSleep = s
 	}
-	return
 }
 
-func (c *Client) basicCmd(ctx context.Context, cmd Command) (r string, err error) {
-	var id uint
+// SetIdleTimeout sets the duration after which an unused
+// connection is closed, the next command redials. A zero
+// duration keeps the connection open until Close is called
+func (c *Client) SetIdleTimeout(t time.Duration) {
+	if t >= 0 {
+		c.idleTimeout = t
+	}
+}
 
-	c.m.Lock()
-	if c.tc == nil {
-		if c.conn, err = c.dial(ctx); err != nil {
-			c.m.Unlock()
-			return
-		}
+// SetReadBufferSize sets the size of the buffer used to read
+// responses from the server, the default is 4096 bytes and
+// sizes below 512 bytes are ignored. Larger buffers reduce the
+// number of reads for large batches of responses
+func (c *Client) SetReadBufferSize(n int) {
+	if n >= minReadBufSize {
+		c.readBufSize = n
+	}
+}
 
-		c.tc = textproto.NewConn(c.conn)
+// SetWriteBufferSize sets the size of the buffer used to write
+// commands to the server, the default is 4096 bytes and sizes
+// below 512 bytes are ignored. Larger buffers reduce the number
+// of writes when queuing large batches of files
+func (c *Client) SetWriteBufferSize(n int) {
+	if n >= minWriteBufSize {
+		c.writeBufSize = n
 	}
-	c.m.Unlock()
+}
 
-	defer c.conn.SetDeadline(ZeroTime)
+// SetQueueBatchSize sets the maximum number of files submitted
+// in a single QUEUE, larger sets of files are scanned in several
+// batches. The default of 0 submits all the files at once
+func (c *Client) SetQueueBatchSize(n int) {
+	if n >= 0 {
+		c.queueBatchSize = n
+	}
+}
 
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if id, err = c.tc.Cmd("%s", cmd); err != nil {
-		return
+// SetMaxConcurrency sets the maximum number of commands in
+// flight at once, the limit is shared with the clients used by
+// ScanDirParallel. The default of 0 means there is no limit
+func (c *Client) SetMaxConcurrency(n int) {
+	c.sem = nil
+	if n > 0 {
+		c.sem = make(chan struct{}, n)
 	}
+}
 
-	c.tc.StartResponse(id)
-	defer c.tc.EndResponse(id)
+// SetContentLengthFunc sets a function used to determine the
+// length of the readers passed to ScanReader, readers for which
+// fn returns false are sized by the client which buffers those
+// it does not know
+func (c *Client) SetContentLengthFunc(fn func(io.Reader) (int64, bool)) {
+	c.contentLength = fn
+}
 
-	if cmd == Quit {
-		return
+// Stats returns a snapshot of the client counters
+func (c *Client) Stats() (s Stats) {
+	s = Stats{
+		Scans:    atomic.LoadUint64(&c.stats.Scans),
+		Infected: atomic.LoadUint64(&c.stats.Infected),
+		Errors:   atomic.LoadUint64(&c.stats.Errors),
+		Bytes:    atomic.LoadUint64(&c.stats.Bytes),
 	}
+	return
+}
 
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if r, err = c.tc.ReadLine(); err != nil {
-		return
+// SelfTest streams the EICAR test string to the server and
+// checks that it is detected, a nil error means the server is
+// reachable and detecting
+func (c *Client) SelfTest(ctx context.Context) (err error) {
+	var r []*Response
+
+	if r, err = c.ScanFileReader(ctx, "eicar.com", strings.NewReader(eicarTest), int64(len(eicarTest))); err != nil {
+		if _, ok := err.(*ScanError); !ok {
+			return
+		}
 	}
 
-	if cmd == Help {
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if _, err = c.tc.ReadLine(); err != nil {
+	for _, rs := range r {
+		if rs.Infected && strings.Contains(strings.ToUpper(rs.Signature), "EICAR") {
+			err = nil
 			return
 		}
 	}
 
+	if len(r) == 0 {
+		err = fmt.Errorf(selfTestErr, "no response")
+		return
+	}
+
+	err = fmt.Errorf(selfTestErr, r[0].Raw)
+
 	return
 }
 
-func (c *Client) fileCmd(ctx context.Context, cmd Command, p ...string) (r []*Response, err error) {
-	var n int
+// Config returns a copy of the client configuration, like the
+// setters it must not be called concurrently with them
+func (c *Client) Config() (cfg ClientConfig) {
+	cfg = ClientConfig{
+		Address:          c.address,
+		Network:          c.network,
+		ConnTimeout:      c.connTimeout,
+		ConnRetries:      c.connRetries,
+		ConnSleep:        c.connSleep,
+		TotalDialTimeout: c.totalDialTimeout,
+		CmdTimeout:       c.cmdTimeout,
+		StreamTimeout:    c.streamTimeout,
+		ScanTimeout:      c.scanTimeout,
+		IdleTimeout:      c.idleTimeout,
+	}
+	return
+}
 
-	n = len(p)
+// Info returns server information
+func (c *Client) Info(ctx context.Context) (i Info, err error) {
+	var s string
+	if s, err = c.basicCmd(ctx, Help); err != nil {
+		return
+	}
 
-	if n == 0 || p[0] == "" {
-		err = fmt.Errorf("Atleast one path to scan is required")
+	i.Raw = s
+	ms := helpRe.FindStringSubmatch(strings.Join(strings.Fields(s), " "))
+	if ms == nil {
+		err = &BannerError{Raw: s}
 		return
 	}
 
-	c.m.Lock()
-	if c.tc == nil {
-		if c.conn, err = c.dial(ctx); err != nil {
-			c.m.Unlock()
-			return
-		}
+	i.Version = ms[1]
+	i.Engine = ms[2]
+	i.Protocol = ms[3]
+	i.Signature = ms[4]
+	i.Uptime = ms[5]
 
-		c.tc = textproto.NewConn(c.conn)
+	if _, ok := parseVersion(i.Protocol); !ok {
+		c.logger.Printf("fprot: unexpected protocol version: %s", i.Protocol)
 	}
+
+	c.m.Lock()
+	c.protocol = i.Protocol
 	c.m.Unlock()
 
-	defer c.conn.SetDeadline(ZeroTime)
+	return
+}
 
-	id := c.tc.Next()
-	c.tc.StartRequest(id)
+// SupportsProtocol returns true if the protocol version reported
+// by the server is at least min, the version is obtained by Info
+// and false is returned if Info has not been called
+func (c *Client) SupportsProtocol(min string) bool {
+	c.m.Lock()
+	protocol := c.protocol
+	c.m.Unlock()
 
-	if cmd == ScanStream {
-		if err = c.streamScan(n, p...); err != nil {
-			c.tc.EndRequest(id)
-			return
+	v, ok := parseVersion(protocol)
+	if !ok {
+		return false
+	}
+
+	m, ok := parseVersion(min)
+	if !ok {
+		return false
+	}
+
+	for n := 0; n < len(v) || n < len(m); n++ {
+		var a, b int
+		if n < len(v) {
+			a = v[n]
 		}
-	} else if cmd == ScanFile {
-		if err = c.fileScan(n, p...); err != nil {
-			c.tc.EndRequest(id)
-			return
+		if n < len(m) {
+			b = m[n]
+		}
+		if a != b {
+			return a > b
 		}
 	}
-	c.tc.W.Flush()
-
-	c.tc.EndRequest(id)
-	c.tc.StartResponse(id)
-	defer c.tc.EndResponse(id)
-	r, err = c.processResponse(n)
 
-	return
+	return true
 }
 
-func (c *Client) fileScan(n int, p ...string) (err error) {
-	if n > 1 {
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if err = c.tc.PrintfLine("%s", Queue); err != nil {
-			return
-		}
-
-		for _, fn := range p {
-			c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-			if err = c.tc.PrintfLine("%s %s", ScanFile, fn); err != nil {
-				return
-			}
-		}
+// parseVersion parses a dotted version string
+func parseVersion(s string) (v []int, ok bool) {
+	if s == "" {
+		return
+	}
 
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if err = c.tc.PrintfLine("%s", ScanQueue); err != nil {
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return
+		}
+		v = append(v, n)
+	}
+	ok = true
+
+	return
+}
+
+// Close sends QUIT and closes the server connection, the
+// connection is closed without waiting for QUIT to be sent
+// once ctx is done. The client can be reused after Close,
+// the next command establishes a new connection
+func (c *Client) Close(ctx context.Context) (err error) {
+	c.m.Lock()
+	if c.reaper != nil {
+		c.reaper.Stop()
+		c.reaper = nil
+	}
+	c.m.Unlock()
+
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	c.m.Lock()
+	tc, conn := c.tc, c.conn
+	c.m.Unlock()
+
+	if tc == nil {
+		return
+	}
+	defer c.discard()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock a pending write on a wedged connection
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	_, err = c.basicCmd(ctx, Quit)
+
+	return
+}
+
+// RawCommand sends a command line that is not modelled by the
+// client to the server and returns the lines of the response,
+// the response ends at an empty line. The command is not resent
+// when it fails as it may not be safe to repeat. The protocol
+// has no command to set the scanning options of a session, they
+// are set in the server configuration
+func (c *Client) RawCommand(ctx context.Context, line string) (r []string, err error) {
+	r, err = c.rawCmd(ctx, line)
+	return
+}
+
+// Reset closes the server connection without sending QUIT
+// unlike Close, use it to recover from a connection that is
+// no longer usable. The settings of the client are kept and
+// the next command establishes a new connection
+func (c *Client) Reset() {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.reaper != nil {
+		c.reaper.Stop()
+		c.reaper = nil
+	}
+
+	c.closeConn()
+}
+
+// ScanFile submits a single file for scanning
+func (c *Client) ScanFile(ctx context.Context, f string) (r []*Response, err error) {
+	r, err = c.fileCmd(ctx, ScanFile, f)
+	return
+}
+
+// ScanFiles submits multiple files for scanning
+func (c *Client) ScanFiles(ctx context.Context, f ...string) (r []*Response, err error) {
+	r, err = c.fileCmd(ctx, ScanFile, f...)
+	return
+}
+
+// ScanFilesOrdered submits multiple files for scanning and
+// returns the responses in the order of the files, a response
+// with the SkipError status code is returned for each file the
+// server did not respond to
+func (c *Client) ScanFilesOrdered(ctx context.Context, f ...string) (r []*Response, err error) {
+	r, err = c.fileCmd(ctx, ScanFile, f...)
+	r = orderResponses(f, r)
+	return
+}
+
+// ScanStream submits a stream for scanning
+func (c *Client) ScanStream(ctx context.Context, f ...string) (r []*Response, err error) {
+	r, err = c.fileCmd(ctx, ScanStream, f...)
+	return
+}
+
+// ScanReader submits an io reader via a stream for scanning,
+// readers of an unknown length such as os.Stdin when it is a
+// pipe are buffered to determine the length. The content is sent
+// as is, fpscand can not accept a compressed stream, it would be
+// scanned as an archive
+func (c *Client) ScanReader(ctx context.Context, i io.Reader) (r []*Response, err error) {
+	r, err = c.readerCmd(ctx, streamName, i)
+	return
+}
+
+// ScanReaderWithSize submits an io reader of a known size via
+// a stream for scanning, exactly size bytes are read from i
+func (c *Client) ScanReaderWithSize(ctx context.Context, i io.Reader, size int64) (r []*Response, err error) {
+	r, err = c.sizedReaderCmd(ctx, streamName, i, size)
+	return
+}
+
+// IsInfected submits an io reader of a known size via a stream
+// for scanning and returns true with the signature if it is
+// infected. An error status on a clean stream is returned as a
+// ScanError as the content may not have been fully scanned
+func (c *Client) IsInfected(ctx context.Context, i io.Reader, size int64) (infected bool, signature string, err error) {
+	var r []*Response
+
+	r, err = c.sizedReaderCmd(ctx, streamName, i, size)
+	for _, rs := range r {
+		if rs.Infected {
+			infected, signature, err = true, rs.Signature, nil
+			return
+		}
+	}
+
+	return
+}
+
+// ScanOpenFile submits an open file via a stream for scanning
+// without reopening it, the whole file is sent regardless of
+// the file offset which is left unchanged. Pipes and devices
+// such as os.Stdin are read until EOF
+func (c *Client) ScanOpenFile(ctx context.Context, f *os.File) (r []*Response, err error) {
+	var stat os.FileInfo
+
+	if stat, err = f.Stat(); err != nil {
+		return
+	}
+
+	if !stat.Mode().IsRegular() {
+		r, err = c.readerCmd(ctx, f.Name(), f)
+		return
+	}
+
+	r, err = c.sizedReaderCmd(ctx, f.Name(), io.NewSectionReader(f, 0, stat.Size()), stat.Size())
+
+	return
+}
+
+// ScanStreamReader submits an io reader of a known size via a
+// stream for scanning while writing the content to w as it is
+// sent. If an error occurs w holds the content read until then,
+// an error writing to w aborts the scan
+func (c *Client) ScanStreamReader(ctx context.Context, i io.Reader, size int64, w io.Writer) (r []*Response, err error) {
+	r, err = c.sizedReaderCmd(ctx, streamName, io.TeeReader(i, w), size)
+	return
+}
+
+// ScanFileReader submits an io reader of a known size via a
+// stream named name for scanning, the name is used as the
+// filename of the responses
+func (c *Client) ScanFileReader(ctx context.Context, name string, i io.Reader, size int64) (r []*Response, err error) {
+	r, err = c.sizedReaderCmd(ctx, name, i, size)
+	return
+}
+
+// ScanArchiveMembers reads the tar or zip archive from i and
+// submits each of the regular files in it as a stream named by
+// its path in the archive, the responses are returned keyed by
+// the member name. The format is one of tar, tar.gz, tgz or zip,
+// the scan timeout applies to the whole archive
+func (c *Client) ScanArchiveMembers(ctx context.Context, i io.Reader, format string) (r map[string][]*Response, err error) {
+	r = make(map[string][]*Response)
+
+	ctx, cancel := c.scanContext(ctx)
+	defer cancel()
+
+	scan := func(name string, m io.Reader, size int64) error {
+		rs, e := c.sizedReaderCmd(ctx, name, m, size)
+		r[name] = append(r[name], rs...)
+		if _, ok := e.(*ScanError); ok {
+			if err == nil {
+				err = e
+			}
+			return nil
+		}
+		return e
+	}
+
+	var e error
+	switch strings.ToLower(format) {
+	case "tar":
+		e = tarMembers(i, scan)
+	case "tar.gz", "tgz":
+		var gz *gzip.Reader
+		if gz, e = gzip.NewReader(i); e == nil {
+			e = tarMembers(gz, scan)
+			gz.Close()
+		}
+	case "zip":
+		e = c.zipMembers(i, scan)
+	default:
+		e = fmt.Errorf(archiveFormatErr, format)
+	}
+
+	if e != nil {
+		err = e
+	}
+
+	return
+}
+
+// tarMembers calls fn with each regular file in the archive
+func tarMembers(i io.Reader, fn func(string, io.Reader, int64) error) (err error) {
+	var hdr *tar.Header
+
+	tr := tar.NewReader(i)
+	for {
+		if hdr, err = tr.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		if err = fn(hdr.Name, tr, hdr.Size); err != nil {
+			return
+		}
+	}
+}
+
+// zipMembers calls fn with each regular file in the archive,
+// readers that do not support random access are spooled
+func (c *Client) zipMembers(i io.Reader, fn func(string, io.Reader, int64) error) (err error) {
+	var clen int64
+	var cleanup func()
+	var zr *zip.Reader
+
+	if i, clen, cleanup, err = c.sizeReader(i); err != nil {
+		return
+	}
+	defer cleanup()
+
+	ra, ok := i.(io.ReaderAt)
+	if !ok {
+		var b []byte
+		if b, err = ioutil.ReadAll(i); err != nil {
+			return
+		}
+		ra = bytes.NewReader(b)
+	}
+
+	if zr, err = zip.NewReader(ra, clen); err != nil {
+		return
+	}
+
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		var rc io.ReadCloser
+		if rc, err = f.Open(); err != nil {
+			return
+		}
+
+		err = fn(f.Name, rc, int64(f.UncompressedSize64))
+		rc.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// ScanDir submits a directory for scanning, files that could
+// not be read while walking the directory are reported via
+// a WalkError once the readable files have been scanned
+func (c *Client) ScanDir(ctx context.Context, d string) (r []*Response, err error) {
+	r, err = c.dirCmd(ctx, ScanFile, d)
+	return
+}
+
+// PlanDir returns the files ScanDir would submit for scanning
+// after applying the configured filters, no connection is made.
+// Files that could not be read are reported via a WalkError
+func (c *Client) PlanDir(d string) (fl []string, err error) {
+	var werr error
+
+	if fl, _, werr, err = c.dirFiles(d); err != nil {
+		return
+	}
+
+	if c.maxFileSize > 0 {
+		fl, _ = c.skipOversized(fl)
+	}
+
+	err = werr
+
+	return
+}
+
+// ScanFS submits the files under root in fsys via streams for
+// scanning, the filenames of the responses are the paths within
+// fsys. The directory filters of ScanDir are applied. Files that
+// could not be read are reported via a WalkError once the others
+// have been scanned
+func (c *Client) ScanFS(ctx context.Context, fsys fs.FS, root string) (r []*Response, err error) {
+	var errs []error
+	var gerr error
+
+	ctx, cancel := c.scanContext(ctx)
+	defer cancel()
+
+	werr := fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+
+		rel := fsRel(root, p)
+		if rel != "." && c.listOpts.excluded(filepath.FromSlash(rel)) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			if rel != "." && c.listOpts.limitDepth && strings.Count(rel, "/")+1 > c.listOpts.maxDepth {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || !c.listOpts.allowed(p) {
+			return nil
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		rs, err := c.scanFSFile(ctx, fsys, p)
+		r = append(r, rs...)
+		if err != nil {
+			if _, ok := err.(*ScanError); !ok {
+				errs = append(errs, err)
+			} else if gerr == nil {
+				gerr = err
+			}
+		}
+
+		return nil
+	})
+	if werr != nil {
+		err = werr
+		return
+	}
+
+	err = gerr
+	if len(errs) > 0 {
+		err = walkError(err, &WalkError{Errors: errs})
+	}
+
+	return
+}
+
+func (c *Client) scanFSFile(ctx context.Context, fsys fs.FS, p string) (r []*Response, err error) {
+	var f fs.File
+	var stat fs.FileInfo
+
+	if f, err = fsys.Open(p); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if stat, err = f.Stat(); err != nil {
+		return
+	}
+
+	if c.maxFileSize > 0 && stat.Size() > c.maxFileSize {
+		r = []*Response{{
+			Filename:   p,
+			Status:     oversizeStatus,
+			StatusCode: SkipError,
+		}}
+		return
+	}
+
+	r, err = c.sizedReaderCmd(ctx, p, f, stat.Size())
+
+	return
+}
+
+// fsRel returns the path p of an FS relative to root
+func fsRel(root, p string) string {
+	if root == "." {
+		return p
+	}
+	if p == root {
+		return "."
+	}
+	return strings.TrimPrefix(p, root+"/")
+}
+
+// ScanPaths submits a mix of files and directories for scanning,
+// directories are expanded like ScanDir. Paths that could not be
+// read are reported via a WalkError once the others are scanned
+func (c *Client) ScanPaths(ctx context.Context, paths ...string) (r []*Response, err error) {
+	var fl []string
+	var skipped []*Response
+	var errs []error
+
+	for _, p := range paths {
+		stat, e := os.Stat(p)
+		if e != nil {
+			errs = append(errs, e)
+			continue
+		}
+
+		if !stat.IsDir() {
+			fl = append(fl, p)
+			continue
+		}
+
+		dfl, ds, werr, e := c.dirFiles(p)
+		if e == nil {
+			e = werr
+		}
+		if we, ok := e.(*WalkError); ok {
+			errs = append(errs, we.Errors...)
+		} else if e != nil {
+			errs = append(errs, e)
+		}
+		fl = append(fl, dfl...)
+		skipped = append(skipped, ds...)
+	}
+
+	if len(fl) > 0 || (len(skipped) == 0 && len(errs) == 0) {
+		if err = c.fileFunc(ctx, ScanFile, collect(&r), fl...); err != nil {
+			if _, ok := err.(*ScanError); !ok {
+				return
+			}
+		}
+	}
+
+	r = append(r, skipped...)
+
+	if len(errs) > 0 {
+		err = walkError(err, &WalkError{Errors: errs})
+	}
+
+	return
+}
+
+// ScanDirInfected submits a directory for scanning like ScanDir
+// but only returns the responses that are infected or have an
+// error status, the summary counts all the responses of the scan
+func (c *Client) ScanDirInfected(ctx context.Context, d string) (s Summary, r []*Response, err error) {
+	err = c.dirFunc(ctx, ScanFile, d, summarize(&s, collectInfected(&r)))
+	return
+}
+
+// ScanDirSummary submits a directory for scanning like ScanDir
+// and also returns the counts of the responses
+func (c *Client) ScanDirSummary(ctx context.Context, d string) (s Summary, r []*Response, err error) {
+	err = c.dirFunc(ctx, ScanFile, d, summarize(&s, collect(&r)))
+	return
+}
+
+// ScanDirStream submits a directory for scanning as streams,
+// walk errors are reported in the same way as ScanDir
+func (c *Client) ScanDirStream(ctx context.Context, d string) (r []*Response, err error) {
+	r, err = c.dirCmd(ctx, ScanStream, d)
+	return
+}
+
+// ScanDirStreamFunc submits a directory for scanning as streams
+// calling fn with each response as it is received, the scan is
+// aborted if fn returns an error. fn must not use the client
+func (c *Client) ScanDirStreamFunc(ctx context.Context, d string, fn func(*Response) error) (err error) {
+	err = c.dirFunc(ctx, ScanStream, d, fn)
+	return
+}
+
+// ScanDirStreamChan submits a directory for scanning as streams
+// sending each response on the returned response channel as it
+// is received. Both channels are closed when the scan completes
+// or the context is cancelled, the error channel delivers at
+// most one terminal error
+func (c *Client) ScanDirStreamChan(ctx context.Context, d string) (<-chan *Response, <-chan error) {
+	rc := make(chan *Response)
+	ec := make(chan error, 1)
+
+	go func() {
+		defer close(ec)
+		defer close(rc)
+
+		err := c.dirFunc(ctx, ScanStream, d, func(rs *Response) error {
+			select {
+			case rc <- rs:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			ec <- err
+		}
+	}()
+
+	return rc, ec
+}
+
+// ScanDirParallel submits a directory for scanning using upto
+// workers concurrent connections, the order of the responses
+// does not match the order of the files in the directory
+func (c *Client) ScanDirParallel(ctx context.Context, d string, workers int) (r []*Response, err error) {
+	var fl []string
+	var werr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	ctx, cancel := c.scanContext(ctx)
+	defer cancel()
+
+	if fl, r, werr, err = c.dirFiles(d); err != nil {
+		return
+	}
+
+	if len(fl) == 0 && len(r) == 0 {
+		err = fmt.Errorf("Atleast one path to scan is required")
+		return
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	if workers > len(fl) {
+		workers = len(fl)
+	}
+
+	files := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := c.Clone()
+			defer w.Close(ctx)
+
+			for fn := range files {
+				rs, e := w.fileCmd(ctx, ScanFile, fn)
+				if _, ok := e.(*ScanError); e != nil && !ok {
+					w.discard()
+				}
+
+				mu.Lock()
+				r = append(r, rs...)
+				if e != nil && err == nil {
+					err = e
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for _, fn := range fl {
+		select {
+		case files <- fn:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(files)
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	err = walkError(err, werr)
+
+	return
+}
+
+// ScanReaders submits each of the readers via a stream named by
+// its key using upto concurrency concurrent connections, the
+// responses are returned keyed by name. The readers are sized
+// in the same way as ScanReader
+func (c *Client) ScanReaders(ctx context.Context, readers map[string]io.Reader, concurrency int) (r map[string][]*Response, err error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	ctx, cancel := c.scanContext(ctx)
+	defer cancel()
+
+	if len(readers) == 0 {
+		err = fmt.Errorf("Atleast one reader to scan is required")
+		return
+	}
+
+	names := make([]string, 0, len(readers))
+	for name := range readers {
+		if name == "" || strings.ContainsAny(name, "\r\n") {
+			err = fmt.Errorf(invalidNameErr, name)
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	if concurrency > len(names) {
+		concurrency = len(names)
+	}
+
+	r = make(map[string][]*Response, len(names))
+	queue := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := c.Clone()
+			defer w.Close(ctx)
+
+			for name := range queue {
+				rs, e := w.readerCmd(ctx, name, readers[name])
+				if _, ok := e.(*ScanError); e != nil && !ok {
+					w.discard()
+				}
+
+				mu.Lock()
+				r[name] = rs
+				if e != nil && err == nil {
+					err = e
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for _, name := range names {
+		select {
+		case queue <- name:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Clone returns a new unconnected client with the same settings,
+// the clone has its own connection and stats. The limit set by
+// SetMaxConcurrency is shared with the clone
+func (c *Client) Clone() *Client {
+	return &Client{settings: c.settings}
+}
+
+// Dial connects to the server if a connection has not
+// already been established, commands dial automatically
+// so this is only required to verify connectivity upfront
+func (c *Client) Dial(ctx context.Context) (err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.tc != nil {
+		return
+	}
+
+	if c.conn, err = c.dial(ctx); err != nil {
+		return
+	}
+
+	c.tc = textproto.NewConn(c.conn)
+	if c.readBufSize != defaultReadBufSize {
+		c.tc.R = bufio.NewReaderSize(c.conn, c.readBufSize)
+	}
+	if c.writeBufSize != defaultWriteBufSize {
+		c.tc.W = bufio.NewWriterSize(c.conn, c.writeBufSize)
+	}
+	c.lastUsed = time.Now()
+
+	return
+}
+
+func (c *Client) dial(ctx context.Context) (conn net.Conn, err error) {
+	if c.totalDialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.totalDialTimeout)
+		defer cancel()
+	}
+
+	for i := 0; i <= c.connRetries; i++ {
+		if i > 0 {
+			if err = sleep(ctx, c.retrySleep(i)); err != nil {
+				return
+			}
+		}
+		conn, err = c.dialOnce(ctx)
+		if err == nil || ctx.Err() != nil || !c.dialRetryable(err) {
+			break
+		}
+	}
+	return
+}
+
+// dialRetryable returns true for dial errors that are likely to
+// be resolved by retrying such as a server that is restarting
+func (c *Client) dialRetryable(err error) bool {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	return c.retryableErrors != nil && c.retryableErrors(err)
+}
+
+// retrySleep returns the time to wait before the given retry
+// attempt, the first retry is attempt 1
+func (c *Client) retrySleep(attempt int) time.Duration {
+	if c.backoffBase <= 0 {
+		return c.connSleep
+	}
+
+	return jitter(c.backoff(attempt))
+}
+
+// backoff returns the exponential backoff before the given
+// retry attempt capped at the maximum backoff
+func (c *Client) backoff(attempt int) time.Duration {
+	d := float64(c.backoffBase) * math.Pow(c.backoffFactor, float64(attempt-1))
+	if d > float64(c.backoffMax) {
+		return c.backoffMax
+	}
+
+	return time.Duration(d)
+}
+
+// jitter randomizes d between half of d and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// scanContext returns a context bounded by the scan timeout
+func (c *Client) scanContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.scanTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, c.scanTimeout)
+}
+
+// contextErr returns the context error, the socket deadline
+// derived from the context can expire before the context does
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+// sleep pauses for d returning early with the context error
+// if ctx is done
+func sleep(ctx context.Context, d time.Duration) (err error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+func (c *Client) dialOnce(ctx context.Context) (conn net.Conn, err error) {
+	var d ContextDialer
+
+	switch v := c.dialer.(type) {
+	case nil:
+		d = &net.Dialer{
+			Timeout:   c.connTimeout,
+			KeepAlive: c.keepAlive,
+			LocalAddr: c.localAddr,
+		}
+	case *net.Dialer:
+		if v.Timeout == 0 || (v.LocalAddr == nil && c.localAddr != nil) {
+			nd := *v
+			if nd.Timeout == 0 {
+				nd.Timeout = c.connTimeout
+			}
+			if nd.LocalAddr == nil {
+				nd.LocalAddr = c.localAddr
+			}
+			v = &nd
+		}
+		d = v
+	default:
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.connTimeout)
+		defer cancel()
+		d = v
+	}
+
+	if conn, err = d.DialContext(ctx, c.network, c.address); err != nil {
+		return
+	}
+
+	if _, ok := c.dialer.(*net.Dialer); !ok && c.dialer != nil {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(c.keepAlive > 0)
+			if c.keepAlive > 0 {
+				tc.SetKeepAlivePeriod(c.keepAlive)
+			}
+		}
+	}
+
+	if c.tlsConfig == nil {
+		return
+	}
+
+	cfg := c.tlsConfig
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		cfg = cfg.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(c.address)
+	}
+
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(c.connTimeout))
+	if err = tc.Handshake(); err != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+	tc.SetDeadline(ZeroTime)
+	conn = tc
+
+	return
+}
+
+// effectiveDeadline returns the earlier of the command
+// timeout and the deadline set on the context
+func (c *Client) effectiveDeadline(ctx context.Context) (t time.Time) {
+	t = time.Now().Add(c.cmdTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		t = d
+	}
+	return
+}
+
+func (c *Client) basicCmd(ctx context.Context, cmd Command) (r string, err error) {
+	if cmd == Quit {
+		r, err = c.basicCmdOnce(ctx, cmd)
+		return
+	}
+
+	err = c.retry(ctx, func() (partial bool, err error) {
+		r, err = c.basicCmdOnce(ctx, cmd)
+		return
+	})
+
+	return
+}
+
+func (c *Client) rawCmd(ctx context.Context, line string) (r []string, err error) {
+	if strings.TrimSpace(line) == "" || strings.ContainsAny(line, "\r\n") {
+		err = fmt.Errorf(invalidCmdErr, line)
+		return
+	}
+
+	// The effect of an unknown command is not known, it
+	// is treated as partial so that it is never resent
+	err = c.retry(ctx, func() (partial bool, err error) {
+		r, err = c.rawCmdOnce(ctx, line)
+		partial = true
+		return
+	})
+
+	return
+}
+
+func (c *Client) rawCmdOnce(ctx context.Context, line string) (r []string, err error) {
+	var id uint
+	var l string
+
+	if err = c.Dial(ctx); err != nil {
+		return
+	}
+
+	defer c.conn.SetDeadline(ZeroTime)
+
+	c.conn.SetDeadline(c.effectiveDeadline(ctx))
+	c.logger.Printf("> %s", line)
+	if id, err = c.tc.Cmd("%s", line); err != nil {
+		return
+	}
+
+	c.tc.StartResponse(id)
+	defer c.tc.EndResponse(id)
+
+	// Responses end with an empty line
+	for {
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
+		if l, err = c.tc.ReadLine(); err != nil {
+			return
+		}
+		c.logger.Printf("< %s", l)
+		if l == "" {
+			break
+		}
+		r = append(r, l)
+	}
+
+	return
+}
+
+func (c *Client) basicCmdOnce(ctx context.Context, cmd Command) (r string, err error) {
+	var id uint
+
+	if err = c.Dial(ctx); err != nil {
+		return
+	}
+
+	defer c.conn.SetDeadline(ZeroTime)
+
+	c.conn.SetDeadline(c.effectiveDeadline(ctx))
+	c.logger.Printf("> %s", cmd)
+	if id, err = c.tc.Cmd("%s", cmd); err != nil {
+		return
+	}
+
+	c.tc.StartResponse(id)
+	defer c.tc.EndResponse(id)
+
+	if cmd == Quit {
+		return
+	}
+
+	c.conn.SetDeadline(c.effectiveDeadline(ctx))
+	if r, err = c.tc.ReadLine(); err != nil {
+		return
+	}
+	c.logger.Printf("< %s", r)
+
+	// The banner can span several lines and is terminated
+	// by an empty line
+	if cmd == Help {
+		var l string
+		for {
+			c.conn.SetDeadline(c.effectiveDeadline(ctx))
+			if l, err = c.tc.ReadLine(); err != nil {
+				return
+			}
+			c.logger.Printf("< %s", l)
+			if strings.TrimSpace(l) == "" {
+				break
+			}
+			r += "\n" + l
+		}
+	}
+
+	return
+}
+
+// printfLine writes a command line to the server
+func (c *Client) printfLine(format string, args ...interface{}) error {
+	c.logger.Printf("> "+format, args...)
+	return c.tc.PrintfLine(format, args...)
+}
+
+func (c *Client) dirCmd(ctx context.Context, cmd Command, d string) (r []*Response, err error) {
+	err = c.dirFunc(ctx, cmd, d, collect(&r))
+	return
+}
+
+// collectInfected returns a function that appends the responses
+// that are infected or have an error status to r
+func collectInfected(r *[]*Response) func(*Response) error {
+	return func(rs *Response) error {
+		if rs.Infected || rs.HasError() {
+			*r = append(*r, rs)
+		}
+		return nil
+	}
+}
+
+func (c *Client) dirFunc(ctx context.Context, cmd Command, d string, fn func(*Response) error) (err error) {
+	var fl []string
+	var werr error
+
+	var skipped []*Response
+
+	if fl, skipped, werr, err = c.dirFiles(d); err != nil {
+		return
+	}
+
+	if len(fl) > 0 || len(skipped) == 0 {
+		if err = c.fileFunc(ctx, cmd, fn, fl...); err != nil {
+			if _, ok := err.(*ScanError); !ok {
+				return
+			}
+		}
+	}
+
+	for _, rs := range skipped {
+		if e := fn(rs); e != nil {
+			err = e
+			return
+		}
+	}
+
+	err = walkError(err, werr)
+
+	return
+}
+
+// dirFiles returns the files to scan in a directory along with
+// a skip response for each unreadable entry, a WalkError is
+// returned in werr if some readable files were found
+func (c *Client) dirFiles(d string) (fl []string, skipped []*Response, werr, err error) {
+	var l *fileLister
+
+	l, err = listFiles(d, c.listOpts)
+	if l != nil {
+		fl = l.files
+		for _, fn := range l.unreadable {
+			skipped = append(skipped, &Response{
+				Filename:   fn,
+				Status:     unreadableStatus,
+				StatusCode: SkipError,
+			})
+		}
+	}
+
+	if err != nil {
+		if _, ok := err.(*WalkError); ok && (len(fl) > 0 || len(skipped) > 0) {
+			werr = err
+			err = nil
+		}
+	}
+
+	return
+}
+
+func (c *Client) fileCmd(ctx context.Context, cmd Command, p ...string) (r []*Response, err error) {
+	err = c.fileFunc(ctx, cmd, collect(&r), p...)
+	return
+}
+
+func (c *Client) fileFunc(ctx context.Context, cmd Command, fn func(*Response) error, p ...string) (err error) {
+	var skipped []*Response
+
+	ctx, cancel := c.scanContext(ctx)
+	defer cancel()
+
+	if len(p) == 0 || p[0] == "" {
+		err = fmt.Errorf("Atleast one path to scan is required")
+		return
+	}
+
+	if c.maxFileSize > 0 {
+		p, skipped = c.skipOversized(p)
+	}
+
+	if len(p) > 0 {
+		if err = c.queueFunc(ctx, cmd, fn, p...); err != nil {
+			if e := contextErr(ctx); e != nil {
+				err = e
+			}
+			if _, ok := err.(*ScanError); !ok {
+				return
+			}
+		}
+	}
+
+	for _, rs := range skipped {
+		if e := fn(rs); e != nil {
+			err = e
+			return
+		}
+	}
+
+	return
+}
+
+// skipOversized removes files larger than maxFileSize from the
+// paths to scan returning a skip response for each of them
+func (c *Client) skipOversized(p []string) (fl []string, skipped []*Response) {
+	fl = make([]string, 0, len(p))
+	for _, fn := range p {
+		if stat, err := os.Stat(fn); err == nil && stat.Size() > c.maxFileSize {
+			skipped = append(skipped, &Response{
+				Filename:   fn,
+				Status:     oversizeStatus,
+				StatusCode: SkipError,
+			})
+			continue
+		}
+		fl = append(fl, fn)
+	}
+
+	return
+}
+
+func (c *Client) queueFunc(ctx context.Context, cmd Command, fn func(*Response) error, p ...string) (err error) {
+	var gerr error
+
+	size := len(p)
+	if c.queueBatchSize > 0 && c.queueBatchSize < size {
+		size = c.queueBatchSize
+	}
+
+	for len(p) > 0 {
+		var delivered bool
+
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		batch := p[:size]
+		if len(p) < size {
+			batch = p
+		}
+		p = p[len(batch):]
+
+		err = c.retry(ctx, func() (partial bool, err error) {
+			err = c.queueFuncOnce(ctx, cmd, func(rs *Response) error {
+				delivered = true
+				return fn(rs)
+			}, batch...)
+			partial = delivered || c.streamed
+			return
+		})
+		if err != nil {
+			if _, ok := err.(*ScanError); !ok {
+				return
+			}
+			if gerr == nil {
+				gerr = err
+			}
+		}
+	}
+
+	err = gerr
+
+	return
+}
+
+func (c *Client) queueFuncOnce(ctx context.Context, cmd Command, fn func(*Response) error, p ...string) (err error) {
+	n := len(p)
+
+	if err = c.Dial(ctx); err != nil {
+		return
+	}
+
+	defer c.conn.SetDeadline(ZeroTime)
+
+	id := c.tc.Next()
+	c.tc.StartRequest(id)
+
+	if cmd == ScanStream {
+		var sent map[string]int64
+		if !c.alive() {
+			c.tc.EndRequest(id)
+			c.discard()
+			err = io.EOF
+			return
+		}
+		if sent, err = c.streamScan(ctx, n, p...); err != nil {
+			c.tc.EndRequest(id)
+			c.discard()
+			return
+		}
+		fn = withBytes(fn, sent)
+	} else if cmd == ScanFile {
+		if err = c.fileScan(ctx, n, p...); err != nil {
+			c.tc.EndRequest(id)
+			return
+		}
+	}
+	c.tc.W.Flush()
+
+	c.tc.EndRequest(id)
+	c.tc.StartResponse(id)
+	defer c.tc.EndResponse(id)
+	err = c.readResponses(ctx, n, fn)
+
+	return
+}
+
+func (c *Client) fileScan(ctx context.Context, n int, p ...string) (err error) {
+	if n > 1 {
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
+		if err = c.printfLine("%s", Queue); err != nil {
+			return
+		}
+
+		for _, fn := range p {
+			c.conn.SetDeadline(c.effectiveDeadline(ctx))
+			if err = c.printfLine("%s %s", ScanFile, fn); err != nil {
+				return
+			}
+		}
+
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
+		if err = c.printfLine("%s", ScanQueue); err != nil {
 			return
 		}
 	} else {
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if err = c.tc.PrintfLine("%s %s", ScanFile, p[0]); err != nil {
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
+		if err = c.printfLine("%s %s", ScanFile, p[0]); err != nil {
 			return
 		}
 	}
@@ -410,160 +2243,748 @@ func (c *Client) fileScan(n int, p ...string) (err error) {
 	return
 }
 
-func (c *Client) streamScan(n int, p ...string) (err error) {
+func (c *Client) streamScan(ctx context.Context, n int, p ...string) (sent map[string]int64, err error) {
+	var b int64
+
+	sent = make(map[string]int64, n)
 	if n > 1 {
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if err = c.tc.PrintfLine("%s", Queue); err != nil {
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
+		if err = c.printfLine("%s", Queue); err != nil {
 			return
 		}
 
 		for _, fn := range p {
-			if err = c.streamCmd(fn); err != nil {
+			if b, err = c.streamCmd(ctx, fn); err != nil {
 				return
 			}
+			sent[fn] = b
 		}
 
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if err = c.tc.PrintfLine("%s", ScanQueue); err != nil {
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
+		if err = c.printfLine("%s", ScanQueue); err != nil {
 			return
 		}
 	} else {
-		if err = c.streamCmd(p[0]); err != nil {
+		if b, err = c.streamCmd(ctx, p[0]); err != nil {
 			return
 		}
+		sent[p[0]] = b
 	}
 
 	return
 }
 
-func (c *Client) readerCmd(ctx context.Context, i io.Reader) (r []*Response, err error) {
+func (c *Client) readerCmd(ctx context.Context, name string, i io.Reader) (r []*Response, err error) {
 	var clen int64
+	var ok bool
+
+	if c.contentLength != nil {
+		clen, ok = c.contentLength(i)
+	}
+
+	if !ok {
+		var cleanup func()
+		if i, clen, cleanup, err = c.sizeReader(i); err != nil {
+			return
+		}
+		defer cleanup()
+	}
+
+	r, err = c.sizedReaderCmd(ctx, name, i, clen)
+
+	return
+}
+
+// sizeReader determines the length of a reader, readers of an
+// unknown type are spooled and must be cleaned up once scanned
+func (c *Client) sizeReader(i io.Reader) (o io.Reader, clen int64, cleanup func(), err error) {
 	var stat os.FileInfo
 
-	c.m.Lock()
-	if c.tc == nil {
-		if c.conn, err = c.dial(ctx); err != nil {
-			c.m.Unlock()
+	o, cleanup = i, func() {}
+
+	switch v := i.(type) {
+	case readerWithLen:
+		clen = int64(v.Len())
+	case *os.File:
+		if stat, err = v.Stat(); err != nil {
+			return
+		}
+		if stat.Mode().IsRegular() {
+			clen = stat.Size()
+			break
+		}
+		// Pipes and devices such as stdin do not
+		// report a size, the content is spooled
+		o, clen, cleanup, err = c.spoolReader(i)
+	default:
+		o, clen, cleanup, err = c.spoolReader(i)
+	}
+
+	return
+}
+
+func (c *Client) sizedReaderCmd(ctx context.Context, name string, i io.Reader, clen int64) (r []*Response, err error) {
+	if clen < 0 {
+		err = fmt.Errorf(invalidSizeErr, clen)
+		return
+	}
+
+	if name == "" || strings.ContainsAny(name, "\r\n") {
+		err = fmt.Errorf(invalidNameErr, name)
+		return
+	}
+
+	err = c.retry(ctx, func() (partial bool, err error) {
+		r, err = c.sizedReaderCmdOnce(ctx, name, i, clen)
+		partial = c.streamed
+		return
+	})
+
+	return
+}
+
+func (c *Client) sizedReaderCmdOnce(ctx context.Context, name string, i io.Reader, clen int64) (r []*Response, err error) {
+	var n int64
+
+	if err = c.Dial(ctx); err != nil {
+		return
+	}
+
+	defer c.conn.SetDeadline(ZeroTime)
+
+	if !c.alive() {
+		c.discard()
+		err = io.EOF
+		return
+	}
+
+	id := c.tc.Next()
+	c.tc.StartRequest(id)
+
+	if n, err = c.sendStream(ctx, name, i, clen); err != nil {
+		c.tc.EndRequest(id)
+		c.discard()
+		return
+	}
+
+	c.tc.EndRequest(id)
+	c.tc.StartResponse(id)
+	defer c.tc.EndResponse(id)
+	err = c.readResponses(ctx, 1, withBytes(collect(&r), map[string]int64{name: n}))
+
+	return
+}
+
+// withBytes wraps fn setting the number of bytes streamed on the
+// responses for the streams, archive members are left unset
+func withBytes(fn func(*Response) error, sent map[string]int64) func(*Response) error {
+	return func(rs *Response) error {
+		if b, ok := sent[rs.Filename]; ok && rs.ArchiveItem == "" {
+			rs.Bytes = b
+		}
+		return fn(rs)
+	}
+}
+
+// retry runs cmd retrying it upto connRetries times, sleeping
+// connSleep between attempts, if it fails with a connection error.
+// Commands that failed after content was streamed or responses
+// were returned are not retried to avoid scanning twice
+func (c *Client) retry(ctx context.Context, cmd func() (bool, error)) (err error) {
+	var reconnects []error
+
+	err = c.retryLocked(ctx, cmd, &reconnects)
+
+	// The callback is called without holding the
+	// connection so that it may issue commands
+	if c.onReconnect != nil {
+		for i, e := range reconnects {
+			c.onReconnect(i+1, e)
+		}
+	}
+
+	return
+}
+
+// retryLocked runs cmd holding the connection, the errors that
+// caused a reconnect are appended to reconnects
+func (c *Client) retryLocked(ctx context.Context, cmd func() (bool, error), reconnects *[]error) (err error) {
+	var partial bool
+	var cerr error
+
+	// Commands share the connection, hold it for the whole
+	// request and response cycle
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+
+	c.acquire()
+	defer c.release()
+
+	// The server may have closed a connection that was idle,
+	// a command that fails on it before anything is received
+	// is retried once over a new connection
+	reused := c.connected()
+	stale := false
+
+	for i := 0; i <= c.connRetries; i++ {
+		if i > 0 {
+			if err = sleep(ctx, c.retrySleep(i)); err != nil {
+				return
+			}
+		}
+
+		// Connection failures are retried by dial
+		if err = c.Dial(ctx); err != nil {
 			return
 		}
 
-		c.tc = textproto.NewConn(c.conn)
+		if cerr != nil {
+			*reconnects = append(*reconnects, cerr)
+		}
+
+		c.streamed = false
+		c.streamNames = nil
+		if partial, err = cmd(); err == nil || partial || ctx.Err() != nil {
+			break
+		}
+
+		if reused && !stale && staleConn(err) {
+			stale = true
+			cerr = err
+			c.discard()
+			// Does not count as a retry
+			i--
+			continue
+		}
+
+		if !retryable(err) {
+			break
+		}
+
+		cerr = err
+		c.discard()
+	}
+
+	// A command that timed out may leave a response
+	// pending, the connection can not be reused
+	if _, ok := err.(net.Error); ok || ctx.Err() != nil {
+		c.discard()
+	}
+
+	return
+}
+
+// acquire marks the connection as in use, a connection that
+// has been idle longer than the idle timeout is closed first
+func (c *Client) acquire() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.active == 0 && c.expired() {
+		c.closeConn()
+	}
+	c.active++
+}
+
+// release marks the connection as unused and arms the
+// reaper that closes it once the idle timeout elapses
+func (c *Client) release() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.active--
+	c.lastUsed = time.Now()
+
+	if c.idleTimeout <= 0 || c.tc == nil {
+		return
+	}
+
+	if c.reaper == nil {
+		c.reaper = time.AfterFunc(c.idleTimeout, c.reap)
+	} else {
+		c.reaper.Reset(c.idleTimeout)
+	}
+}
+
+// reap closes the connection if it is still idle
+func (c *Client) reap() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.active == 0 && c.expired() {
+		c.closeConn()
+	}
+}
+
+// expired returns true if the connection has been idle
+// for longer than the idle timeout, c.m must be held
+func (c *Client) expired() bool {
+	return c.idleTimeout > 0 && c.tc != nil && time.Since(c.lastUsed) >= c.idleTimeout
+}
+
+// retryable returns true for errors caused by a broken connection
+func retryable(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if e, ok := err.(net.Error); ok {
+		return !e.Timeout()
+	}
+
+	return false
+}
+
+// staleConn returns true if err shows that the server closed
+// the connection before the command was answered
+func staleConn(err error) bool {
+	return err == io.EOF || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// alive returns false if the server has closed the connection,
+// a stream written to a connection that was closed while idle
+// is only noticed once it has been sent and can not be retried.
+// Connections used within aliveIdle, including those that were
+// just dialed, are not probed
+func (c *Client) alive() bool {
+	if time.Since(c.lastUsed) < aliveIdle {
+		return true
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(aliveWait))
+	defer c.conn.SetReadDeadline(ZeroTime)
+
+	// Nothing is pending on an idle connection
+	_, err := c.tc.R.Peek(1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// check closes the connection if the server has closed it
+// while the client was idle
+func (c *Client) check() {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.tc != nil && !c.alive() {
+		c.closeConn()
+	}
+}
+
+// connected returns true if the client holds a connection
+func (c *Client) connected() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.tc != nil
+}
+
+// discard closes a connection that is no longer usable,
+// the next command will establish a new connection
+func (c *Client) discard() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.closeConn()
+}
+
+// closeConn closes the connection, c.m must be held
+func (c *Client) closeConn() {
+	if c.tc != nil {
+		c.tc.Close()
+		c.tc = nil
+		c.conn = nil
+	}
+}
+
+// spoolReader buffers a reader of unknown length in order to
+// determine its length, content larger than maxInMemory is
+// spilled to a temporary file which is removed by cleanup
+func (c *Client) spoolReader(i io.Reader) (r io.Reader, clen int64, cleanup func(), err error) {
+	var f *os.File
+	var n int64
+
+	cleanup = func() {}
+	buf := &bytes.Buffer{}
+	if clen, err = io.CopyN(buf, i, c.maxInMemory+1); err != nil {
+		if err == io.EOF {
+			err = nil
+			r = buf
+		}
+		return
+	}
+
+	if f, err = ioutil.TempFile("", "fprot"); err != nil {
+		return
+	}
+
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err = buf.WriteTo(f); err != nil {
+		cleanup()
+		return
+	}
+
+	if n, err = io.Copy(f, i); err != nil {
+		cleanup()
+		return
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return
+	}
+
+	clen += n
+	r = f
+
+	return
+}
+
+func (c *Client) streamCmd(ctx context.Context, fn string) (n int64, err error) {
+	var f *os.File
+	var i io.Reader
+	var clen int64
+	var cleanup func()
+
+	if f, err = os.Open(fn); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if i, clen, cleanup, err = c.sizeReader(f); err != nil {
+		return
+	}
+	defer cleanup()
+
+	n, err = c.sendStream(ctx, fn, i, clen)
+
+	return
+}
+
+// sendStream sends the SCAN STREAM command followed by exactly
+// clen bytes read from i, content that is shorter than declared
+// is an error. The connection must be discarded on error as the
+// server may still be waiting for the rest of the content
+func (c *Client) sendStream(ctx context.Context, name string, i io.Reader, clen int64) (n int64, err error) {
+	token := streamToken(name)
+	if token != name {
+		if c.streamNames == nil {
+			c.streamNames = make(map[string]string)
+		}
+		c.streamNames[token] = name
+	}
+
+	c.conn.SetDeadline(c.effectiveDeadline(ctx))
+	if err = c.printfLine("%s %s SIZE %d", ScanStream, token, clen); err != nil {
+		return
 	}
-	c.m.Unlock()
 
-	defer c.conn.SetDeadline(ZeroTime)
+	c.conn.SetDeadline(c.effectiveDeadline(ctx))
+	if c.streamTimeout > 0 {
+		// The stream timeout bounds each write, keep watching
+		// for a rejection until the content has been sent
+		d, _ := ctx.Deadline()
+		c.conn.SetReadDeadline(d)
+	}
 
-	switch v := i.(type) {
-	case readerWithLen:
-		clen = int64(v.Len())
-	case *os.File:
-		stat, err = v.Stat()
-		if err != nil {
-			return
+	w := &streamWriter{c: c, ctx: ctx}
+	rejected := c.watchRejection(ctx, w.abort)
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// Interrupt the copy of a large stream
+			w.abort()
+		case <-done:
 		}
-		clen = stat.Size()
-	default:
-		err = fmt.Errorf(noSizeErr)
-		return
-	}
+	}()
 
-	id := c.tc.Next()
-	c.tc.StartRequest(id)
+	n, err = c.copyStream(w, io.LimitReader(i, clen))
+	close(done)
+	<-exited
 
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if err = c.tc.PrintfLine("%s stream SIZE %d", ScanStream, clen); err != nil {
-		c.tc.EndRequest(id)
+	if line, ok := rejected(); ok {
+		err = fmt.Errorf(streamRejectedErr, line)
 		return
 	}
-
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if _, err = io.Copy(c.tc.Writer.W, i); err != nil {
-		c.tc.EndRequest(id)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if err == nil && n < clen {
+		err = fmt.Errorf(shortStreamErr, n, clen)
+	}
+	if err != nil {
 		return
 	}
-	c.tc.W.Flush()
 
-	c.tc.EndRequest(id)
-	c.tc.StartResponse(id)
-	defer c.tc.EndResponse(id)
-	r, err = c.processResponse(1)
+	err = c.tc.W.Flush()
 
 	return
 }
 
-func (c *Client) streamCmd(fn string) (err error) {
-	var f *os.File
-	var stat os.FileInfo
+// streamToken returns the name sent for a stream, whitespace
+// ends the name on the command line so names that contain
+// whitespace or the escape character are percent encoded
+func streamToken(name string) string {
+	if !strings.ContainsAny(name, " \t%") {
+		return name
+	}
 
-	if f, err = os.Open(fn); err != nil {
-		return
+	var b strings.Builder
+	for _, r := range name {
+		switch r {
+		case ' ', '\t', '%':
+			fmt.Fprintf(&b, "%%%02X", r)
+		default:
+			b.WriteRune(r)
+		}
 	}
-	defer f.Close()
 
-	if stat, err = f.Stat(); err != nil {
-		return
+	return b.String()
+}
+
+// streamWriter writes the content of a stream, the write deadline
+// is extended by the stream timeout before each write if one is
+// set. Once aborted the pending and later writes fail
+type streamWriter struct {
+	c       *Client
+	ctx     context.Context
+	mu      sync.Mutex
+	aborted bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	if !w.aborted && w.c.streamTimeout > 0 {
+		w.c.conn.SetWriteDeadline(w.c.streamDeadline(w.ctx))
 	}
+	w.mu.Unlock()
 
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if err = c.tc.PrintfLine("%s %s SIZE %d", ScanStream, fn, stat.Size()); err != nil {
-		return
+	return w.c.tc.W.Write(p)
+}
+
+func (w *streamWriter) abort() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.aborted = true
+	w.c.conn.SetWriteDeadline(time.Now())
+}
+
+// streamDeadline returns the earlier of the stream timeout
+// and the deadline set on the context
+func (c *Client) streamDeadline(ctx context.Context) (t time.Time) {
+	t = time.Now().Add(c.streamTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		t = d
+	}
+	return
+}
+
+// watchRejection watches for a response while the content of a
+// stream is sent, a server that rejects the declared size replies
+// straight away and may stop reading the content. abort is called
+// if a line that is not a scan result arrives, the returned func
+// stops watching and returns the line if one was received. Scan
+// results are left to be read with the rest of the response
+func (c *Client) watchRejection(ctx context.Context, abort func()) func() (string, bool) {
+	received := make(chan bool, 1)
+
+	re := c.responseRe
+	if re == nil {
+		re = responseRe
 	}
 
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if _, err = io.Copy(c.tc.Writer.W, f); err != nil {
+	go func() {
+		line, err := c.peekLine()
+		rejected := (err == nil || err == bufio.ErrBufferFull) && !re.Match(line)
+		if rejected {
+			abort()
+		}
+		received <- rejected
+	}()
+
+	return func() (line string, ok bool) {
+		c.conn.SetReadDeadline(time.Now())
+		ok = <-received
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
+		if ok {
+			line, _ = c.tc.R.ReadString('\n')
+			line = strings.TrimRight(line, "\r\n")
+			c.logger.Printf("< %s", line)
+		}
 		return
 	}
+}
 
-	c.tc.W.Flush()
+// peekLine returns the next line without reading it, a line
+// longer than the read buffer is returned with ErrBufferFull
+func (c *Client) peekLine() (line []byte, err error) {
+	for n := 1; ; n = len(line) + 1 {
+		if _, err = c.tc.R.Peek(n); err != nil {
+			return
+		}
+		line, _ = c.tc.R.Peek(c.tc.R.Buffered())
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = bytes.TrimRight(line[:i], "\r")
+			return
+		}
+	}
+}
+
+// copyStream copies the content to the server in chunks of
+// streamChunkSize bytes
+func (c *Client) copyStream(w io.Writer, i io.Reader) (n int64, err error) {
+	c.streamed = true
+
+	bp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bp)
+
+	if cap(*bp) < c.streamChunkSize {
+		*bp = make([]byte, c.streamChunkSize)
+	}
+	buf := (*bp)[:c.streamChunkSize]
 
+	// Hide ReadFrom and WriteTo so that the buffer is used
+	n, err = io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{i}, buf)
+	atomic.AddUint64(&c.stats.Bytes, uint64(n))
 	return
 }
 
-func (c *Client) processResponse(n int) (r []*Response, err error) {
+// readResponses parses the response lines calling fn with each
+// response as it is parsed, if fn returns an error the remaining
+// responses are abandoned and the connection is discarded
+func (c *Client) readResponses(ctx context.Context, n int, fn func(*Response) error) (err error) {
 	var sc int
 	var gerr error
 	var lineb []byte
 
-	for num := 0; num < n; num++ {
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
+	re := c.responseRe
+	if re == nil {
+		re = responseRe
+	}
+
+	// The command has been written, the time taken for each
+	// queued file is approximated by the time between lines.
+	// Archive members are reported on lines of their own in
+	// addition to the line of the file, only the latter count.
+	// fpscand sends exactly one line for each file submitted and
+	// no end of response marker, so the response is delimited by
+	// counting the files. An empty line also ends the response
+	last := time.Now()
+	for num, lines := 0, 0; num < n; lines++ {
+		c.conn.SetDeadline(c.effectiveDeadline(ctx))
 		lineb, err = c.tc.R.ReadBytes('\n')
 		if err != nil {
 			if err == io.EOF {
-				err = nil
-				break
+				// The server closed the connection, it is
+				// an error if nothing was received
+				c.discard()
+				if lines > 0 || len(lineb) > 0 {
+					err = nil
+					break
+				}
 			}
 			return
 		}
 
-		mb := responseRe.FindSubmatch(bytes.TrimRight(lineb, "\n"))
+		lineb = bytes.TrimRight(lineb, "\r\n")
+		c.logger.Printf("< %s", lineb)
+
+		if len(bytes.TrimSpace(lineb)) == 0 {
+			break
+		}
+
+		mb := re.FindSubmatch(lineb)
 		if mb == nil {
+			// The remaining lines can not be matched to
+			// the command, the connection can not be reused
 			err = fmt.Errorf(invalidRespErr, lineb)
-			break
+			c.discard()
+			return
 		}
 
-		rs := Response{}
-		sc, err = strconv.Atoi(string(mb[1]))
+		now := time.Now()
+		rs := Response{Duration: now.Sub(last)}
+		last = now
+
+		sc, err = strconv.Atoi(string(group(re, mb, "statuscode")))
 		if err != nil {
 			return
 		}
 
 		rs.StatusCode = StatusCode(sc)
-		rs.Status = string(mb[2])
-		rs.Signature = string(mb[3])
-		rs.Filename = string(mb[4])
-		rs.ArchiveItem = string(mb[5])
+		rs.Status = string(group(re, mb, "status"))
+		rs.Signatures = splitSignatures(string(group(re, mb, "signature")))
+		if c.signatureTransform != nil {
+			for i, sig := range rs.Signatures {
+				rs.Signatures[i] = c.signatureTransform(sig)
+			}
+		}
+		if len(rs.Signatures) > 0 {
+			rs.Signature = rs.Signatures[0]
+		}
+		rs.Filename = string(group(re, mb, "filename"))
+		if name, ok := c.streamNames[rs.Filename]; ok {
+			rs.Filename = name
+		}
+		if aname := group(re, mb, "aname"); len(aname) > 0 {
+			rs.ArchivePath = strings.Split(string(aname), archiveSep)
+			rs.ArchiveItem = rs.ArchivePath[len(rs.ArchivePath)-1]
+		} else {
+			num++
+		}
 		rs.Raw = string(mb[0])
 
-		r = append(r, &rs)
+		atomic.AddUint64(&c.stats.Scans, 1)
 
-		if rs.StatusCode&(UserError|RestrictionError|SystemError|InternalError|SkipError|DisinfectError) != 0 {
+		if rs.HasError() {
+			atomic.AddUint64(&c.stats.Errors, 1)
 			if gerr == nil {
-				gerr = fmt.Errorf(genericErr, rs.Status)
+				gerr = &ScanError{
+					Code:     rs.StatusCode,
+					Status:   rs.Status,
+					Filename: rs.Filename,
+				}
 			}
 		}
 
-		if rs.StatusCode&(Infected|DisinfectError|HeuristicMatch) != 0 {
+		if rs.StatusCode&c.infectedMask() != 0 {
 			rs.Infected = true
+			atomic.AddUint64(&c.stats.Infected, 1)
+		}
+
+		if c.resultHook != nil {
+			c.resultHook(&rs)
+		}
+
+		if err = fn(&rs); err != nil {
+			c.discard()
+			return
 		}
 	}
 
@@ -572,30 +2993,158 @@ func (c *Client) processResponse(n int) (r []*Response, err error) {
 	return
 }
 
+// group returns the named group of a match or nil if the
+// pattern does not have the group
+func group(re *regexp.Regexp, mb [][]byte, name string) []byte {
+	if i := re.SubexpIndex(name); i >= 0 {
+		return mb[i]
+	}
+
+	return nil
+}
+
+// splitSignatures splits the signature field of a response
+// into the individual signature names
+func splitSignatures(s string) (n []string) {
+	for _, sig := range strings.Split(s, signatureSep) {
+		if sig = strings.TrimSpace(sig); sig != "" {
+			n = append(n, sig)
+		}
+	}
+	return
+}
+
+// collect returns a response func that appends to r
+func collect(r *[]*Response) func(*Response) error {
+	return func(rs *Response) error {
+		*r = append(*r, rs)
+		return nil
+	}
+}
+
+// summarize returns a response func that adds each response
+// to s before calling fn
+func summarize(s *Summary, fn func(*Response) error) func(*Response) error {
+	return func(rs *Response) error {
+		s.add(rs)
+		return fn(rs)
+	}
+}
+
+// orderResponses sorts the responses into the order of the
+// files in p by matching on the filename, archive items follow
+// their archive. Responses that match no file are kept at the end
+func orderResponses(p []string, r []*Response) (o []*Response) {
+	byName := make(map[string][]*Response, len(p))
+	for _, rs := range r {
+		byName[rs.Filename] = append(byName[rs.Filename], rs)
+	}
+
+	o = make([]*Response, 0, len(r))
+	for _, fn := range p {
+		rs, ok := byName[fn]
+		if !ok {
+			o = append(o, &Response{
+				Filename:   fn,
+				Status:     missingStatus,
+				StatusCode: SkipError,
+			})
+			continue
+		}
+		o = append(o, rs...)
+		delete(byName, fn)
+	}
+
+	for _, rs := range r {
+		if _, ok := byName[rs.Filename]; ok {
+			o = append(o, rs)
+		}
+	}
+
+	return
+}
+
 // NewClient creates and returns a new instance of Client
+// The address can either be a host:port pair or the path to
+// a Unix domain socket, either absolute or prefixed with unix:
 func NewClient(address string) (c *Client, err error) {
+	network := "tcp"
 	if address == "" {
 		address = "127.0.0.1:10200"
+	} else if strings.HasPrefix(address, "/") || strings.HasPrefix(address, unixPrefix) {
+		network = "unix"
+		address = strings.TrimPrefix(address, unixPrefix)
+		if address == "" {
+			err = fmt.Errorf(invalidAddrErr)
+			return
+		}
 	} else {
-		if !strings.Contains(address, ":") || strings.Count(address, ":") > 1 {
-			err = fmt.Errorf("The supplied address is invalid")
+		if _, _, err = net.SplitHostPort(address); err != nil {
+			err = fmt.Errorf(invalidAddrErr)
 			return
 		}
 	}
 
 	c = &Client{
-		address:     address,
-		connTimeout: defaultTimeout,
-		connSleep:   defaultSleep,
-		cmdTimeout:  defaultCmdTimeout,
+		settings: settings{
+			address:         address,
+			network:         network,
+			connTimeout:     DefaultConnTimeout,
+			connSleep:       DefaultConnSleep,
+			cmdTimeout:      DefaultCmdTimeout,
+			keepAlive:       defaultKeepAlive,
+			maxInMemory:     defaultMaxInMemory,
+			streamChunkSize: DefaultChunkSize,
+			readBufSize:     defaultReadBufSize,
+			writeBufSize:    defaultWriteBufSize,
+			logger:          nopLogger{},
+		},
+	}
+
+	return
+}
+
+// NewClientConn creates and returns a new instance of Client
+// that uses conn instead of connecting to a server, Close
+// closes conn. The client can not reconnect once conn has been
+// closed or discarded after an error
+func NewClientConn(conn net.Conn) (c *Client) {
+	c, _ = NewClient("")
+	c.dialer = connDialer{}
+	if a := conn.RemoteAddr(); a != nil {
+		c.network, c.address = a.Network(), a.String()
+	}
+	c.conn = conn
+	c.tc = textproto.NewConn(conn)
+	c.lastUsed = time.Now()
+
+	return
+}
+
+// connDialer is the dialer of the clients created by
+// NewClientConn, the supplied connection can not be redialed
+type connDialer struct{}
+
+func (connDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, fmt.Errorf(connClosedErr)
+}
+
+func getFiles(d string, o listOptions) (fl []string, err error) {
+	var l *fileLister
+
+	if l, err = listFiles(d, o); l != nil {
+		fl = l.files
 	}
 
 	return
 }
 
-func getFiles(d string) (fl []string, err error) {
+// listFiles walks a directory returning the lister holding the
+// files found, the lister is returned along with any WalkError
+func listFiles(d string, o listOptions) (l *fileLister, err error) {
 	var stat os.FileInfo
-	if stat, err = os.Stat(d); os.IsNotExist(err) {
+
+	if stat, err = os.Stat(d); err != nil {
 		return
 	}
 
@@ -604,15 +3153,298 @@ func getFiles(d string) (fl []string, err error) {
 		return
 	}
 
-	err = filepath.Walk(d, func(path string, f os.FileInfo, err error) error {
+	l = &fileLister{
+		listOptions: o,
+		seen:        make(map[string]bool),
+	}
+
+	if err = l.walk(d, "", 0); err != nil {
+		l = nil
+		return
+	}
+
+	if len(l.errs) > 0 {
+		err = &WalkError{Errors: l.errs}
+	}
+
+	return
+}
+
+// FileList returns the files that are scanned in a directory
+// by the directory scan methods, files that could not be read
+// are reported via a WalkError along with the readable files
+func FileList(dir string, opts ...ListOption) (fl []string, err error) {
+	var o listOptions
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fl, err = getFiles(dir, o)
+
+	return
+}
+
+// A ListOption configures how FileList walks a directory
+type ListOption func(*listOptions)
+
+// ListFollowSymlinks sets whether symlinks are followed, see
+// Client.SetFollowSymlinks
+func ListFollowSymlinks(b bool) ListOption {
+	return func(o *listOptions) {
+		o.followSymlinks = b
+	}
+}
+
+// ListSkipUnreadable sets whether unreadable files are left
+// out of the list instead of being reported in a WalkError
+func ListSkipUnreadable(b bool) ListOption {
+	return func(o *listOptions) {
+		o.skipUnreadable = b
+	}
+}
+
+// ListMaxDepth sets how deep the directory is walked, see
+// Client.SetMaxDepth
+func ListMaxDepth(n int) ListOption {
+	return func(o *listOptions) {
+		o.limitDepth = n >= 0
+		o.maxDepth = n
+	}
+}
+
+// ListExcludeGlobs sets the patterns of the paths to skip, see
+// Client.SetExcludeGlobs
+func ListExcludeGlobs(globs []string) ListOption {
+	return func(o *listOptions) {
+		o.excludeGlobs = nil
+		for _, g := range globs {
+			if _, err := filepath.Match(g, ""); err == nil && g != "" {
+				o.excludeGlobs = append(o.excludeGlobs, filepath.Clean(g))
+			}
+		}
+	}
+}
+
+// ListIncludeExtensions sets the file extensions to list, see
+// Client.SetIncludeExtensions
+func ListIncludeExtensions(exts []string) ListOption {
+	return func(o *listOptions) {
+		o.includeExts = extensionSet(exts)
+	}
+}
+
+// ListExcludeExtensions sets the file extensions to skip, see
+// Client.SetExcludeExtensions
+func ListExcludeExtensions(exts []string) ListOption {
+	return func(o *listOptions) {
+		o.excludeExts = extensionSet(exts)
+	}
+}
+
+// listOptions controls how directories are walked
+type listOptions struct {
+	followSymlinks bool
+	skipUnreadable bool
+	limitDepth     bool
+	maxDepth       int
+	includeExts    map[string]bool
+	excludeExts    map[string]bool
+	excludeGlobs   []string
+}
+
+// excluded returns true if the relative path matches one
+// of the exclude patterns
+func (o listOptions) excluded(rel string) bool {
+	base := filepath.Base(rel)
+	for _, g := range o.excludeGlobs {
+		if ok, _ := filepath.Match(g, rel); ok {
+			return true
+		}
+		if !strings.ContainsRune(g, filepath.Separator) {
+			if ok, _ := filepath.Match(g, base); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowed returns true if the file passes the extension filters
+func (o listOptions) allowed(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if len(o.includeExts) > 0 && !o.includeExts[ext] {
+		return false
+	}
+	return !o.excludeExts[ext]
+}
+
+func extensionSet(exts []string) (m map[string]bool) {
+	if len(exts) == 0 {
+		return
+	}
+
+	m = make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(ext)
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		m[ext] = true
+	}
+
+	return
+}
+
+// fileLister walks a directory collecting the files to scan,
+// when following symlinks the real paths already visited are
+// tracked in seen to prevent loops and duplicate scans
+type fileLister struct {
+	listOptions
+	files      []string
+	unreadable []string
+	errs       []error
+	seen       map[string]bool
+	root       string
+	prefix     string
+	base       int
+}
+
+// walk walks root whose contents are base levels below the
+// directory being scanned, prefix is the relative path of root
+func (l *fileLister) walk(root, prefix string, base int) (err error) {
+	proot, pprefix, pbase := l.root, l.prefix, l.base
+	l.root, l.prefix, l.base = root, prefix, base
+	err = filepath.Walk(root, l.visit)
+	l.root, l.prefix, l.base = proot, pprefix, pbase
+	return
+}
+
+// rel returns path relative to the directory being scanned
+func (l *fileLister) rel(path string) string {
+	rel, err := filepath.Rel(l.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(l.prefix, rel)
+}
+
+// depth returns the level of the contents of the directory
+// path relative to the directory being scanned
+func (l *fileLister) depth(path string) int {
+	rel, err := filepath.Rel(l.root, path)
+	if err != nil || rel == "." {
+		return l.base
+	}
+	return l.base + strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+func (l *fileLister) visit(path string, f os.FileInfo, err error) error {
+	if err != nil {
+		l.fail(path, err)
+		return nil
+	}
+
+	if path != l.root && len(l.excludeGlobs) > 0 && l.excluded(l.rel(path)) {
+		if f.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	if f.Mode()&os.ModeSymlink != 0 {
+		if l.followSymlinks {
+			l.follow(path)
+		}
+		return nil
+	}
+
+	if f.IsDir() && l.limitDepth && l.depth(path) > l.maxDepth {
+		return filepath.SkipDir
+	}
+
+	if !l.followSymlinks {
 		if !f.IsDir() {
-			fl = append(fl, path)
+			l.add(path)
 		}
 		return nil
-	})
+	}
+
+	rp, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return nil
+	}
+
+	if l.seen[rp] {
+		if f.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	l.seen[rp] = true
+
+	if !f.IsDir() {
+		l.add(path)
+	}
+
+	return nil
+}
+
+func (l *fileLister) add(path string) {
+	if !l.allowed(path) {
+		return
+	}
+
+	if l.skipUnreadable {
+		f, err := os.Open(path)
+		if err != nil {
+			l.fail(path, err)
+			return
+		}
+		f.Close()
+	}
+
+	l.files = append(l.files, path)
+}
+
+// fail records an error, permission errors are recorded as
+// unreadable paths when skipUnreadable is set
+func (l *fileLister) fail(path string, err error) {
+	if l.skipUnreadable && os.IsPermission(err) {
+		l.unreadable = append(l.unreadable, path)
+		return
+	}
+
+	l.errs = append(l.errs, err)
+}
+
+func (l *fileLister) follow(path string) {
+	t, err := filepath.EvalSymlinks(path)
 	if err != nil {
+		l.errs = append(l.errs, err)
 		return
 	}
 
-	return
+	stat, err := os.Stat(t)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return
+	}
+
+	if stat.IsDir() {
+		d := l.depth(path)
+		if l.limitDepth && d > l.maxDepth {
+			return
+		}
+		if err = l.walk(t, l.rel(path), d); err != nil {
+			l.errs = append(l.errs, err)
+		}
+		return
+	}
+
+	if !l.seen[t] {
+		l.seen[t] = true
+		l.add(t)
+	}
 }
@@ -10,19 +10,45 @@ Fprot - Golang F-Prot client
 package fprot
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"go/build"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
 const (
 	eicarVirus = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+	testBanner = "FPSCAND:6.2.3 ENGINE:4.6.5 PROTOCOL:4.6 SIGNATURE:20210101 UPTIME:3600"
 )
 
 type CommandTestKey struct {
@@ -55,7 +81,10 @@ var TestStatusCodes = []StatusCodeTestKey{
 	{InternalError, "Internal Engine error"},
 	{SkipError, "Atleast one object was not scanned"},
 	{DisinfectError, "Atleast one object was disinfected"},
-	{StatusCode(100), ""},
+	{Infected | SkipError, "Atleast one virus-infected object was found, Atleast one object was not scanned"},
+	{StatusCode(100), "Scanning interrupted by user, Internal Engine error, Atleast one object was not scanned"},
+	{StatusCode(256), ""},
+	{StatusCode(257), ""},
 }
 
 func TestCommand(t *testing.T) {
@@ -74,6 +103,85 @@ func TestStatusCode(t *testing.T) {
 	}
 }
 
+func TestMarshalText(t *testing.T) {
+	for _, tt := range TestCommands {
+		b, e := tt.in.MarshalText()
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if string(b) != tt.out {
+			t.Errorf("%d.MarshalText() = %q, want %q", tt.in, b, tt.out)
+		}
+	}
+	for _, tt := range TestStatusCodes {
+		b, e := tt.in.MarshalText()
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if string(b) != tt.out {
+			t.Errorf("%d.MarshalText() = %q, want %q", tt.in, b, tt.out)
+		}
+	}
+	b, e := json.Marshal(map[string]interface{}{"cmd": ScanStream, "status": Infected})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	expected := `{"cmd":"SCAN STREAM","status":"Atleast one virus-infected object was found"}`
+	if string(b) != expected {
+		t.Errorf("Got %s want %s", b, expected)
+	}
+}
+
+func TestStatusDescription(t *testing.T) {
+	for _, tt := range []struct {
+		code   StatusCode
+		status string
+		out    string
+	}{
+		{Infected, "infected", Infected.String()},
+		{StatusCode(200), "skipped", (RestrictionError | SkipError | DisinfectError).String()},
+		{StatusCode(256), "unknown", "unknown"},
+		{StatusCode(1024), "", ""},
+	} {
+		rs := Response{StatusCode: tt.code, Status: tt.status}
+		if s := rs.StatusDescription(); s != tt.out {
+			t.Errorf("%d.StatusDescription() = %q, want %q", tt.code, s, tt.out)
+		}
+	}
+	b, e := json.Marshal(Response{StatusCode: StatusCode(256), Status: "unknown"})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !bytes.Contains(b, []byte(`"status_description":"unknown"`)) {
+		t.Errorf("The server status should be used got %s", b)
+	}
+}
+
+func TestStatusCodeHas(t *testing.T) {
+	c := Infected | SkipError
+	if !c.Has(Infected) {
+		t.Errorf("%d.Has(%d) should be true", c, Infected)
+	}
+	if !c.Has(SkipError) {
+		t.Errorf("%d.Has(%d) should be true", c, SkipError)
+	}
+	if !c.Has(Infected | SkipError) {
+		t.Errorf("%d.Has(%d) should be true", c, Infected|SkipError)
+	}
+	if c.Has(HeuristicMatch) {
+		t.Errorf("%d.Has(%d) should be false", c, HeuristicMatch)
+	}
+	if c.Has(Infected | HeuristicMatch) {
+		t.Errorf("%d.Has(%d) should be false", c, Infected|HeuristicMatch)
+	}
+	if Infected.Has(NoMatch) {
+		t.Errorf("%d.Has(%d) should be false", Infected, NoMatch)
+	}
+	if !NoMatch.Has(NoMatch) {
+		t.Errorf("%d.Has(%d) should be true", NoMatch, NoMatch)
+	}
+}
+
 func TestBasics(t *testing.T) {
 	c, e := NewClient("")
 	if e != nil {
@@ -82,16 +190,30 @@ func TestBasics(t *testing.T) {
 	if c.address != "127.0.0.1:10200" {
 		t.Errorf("Got %q want %q", c.address, "127.0.0.1:10200")
 	}
-	if c.connTimeout != defaultTimeout {
+	if c.connTimeout != DefaultConnTimeout {
 		t.Errorf("The default conn timeout should be set")
 	}
-	if c.connSleep != defaultSleep {
+	if c.connSleep != DefaultConnSleep {
 		t.Errorf("The default conn sleep should be set")
 	}
 	if c.connRetries != 0 {
 		t.Errorf("The default conn retries should be set")
 	}
+	if c.network != "tcp" {
+		t.Errorf("The default dial network should be set")
+	}
+	if c.keepAlive != defaultKeepAlive {
+		t.Errorf("The default keep-alive period should be set")
+	}
 	expected := 2 * time.Second
+	c.SetKeepAlivePeriod(0)
+	if c.keepAlive != defaultKeepAlive {
+		t.Errorf("Calling c.SetKeepAlivePeriod(0) should not change the period")
+	}
+	c.SetKeepAlivePeriod(expected)
+	if c.keepAlive != expected {
+		t.Errorf("Calling c.SetKeepAlivePeriod(%q) failed", expected)
+	}
 	c.SetConnTimeout(expected)
 	if c.connTimeout != expected {
 		t.Errorf("Calling c.SetConnTimeout(%q) failed", expected)
@@ -112,7 +234,27 @@ func TestBasics(t *testing.T) {
 	if c.connRetries != 0 {
 		t.Errorf("Preventing negative values in c.SetConnRetries(%q) failed", -2)
 	}
-	if _, e = NewClient("/var/lib/ms/ms.sock"); e == nil {
+	c.SetDialNetwork("tcp6")
+	if c.network != "tcp6" {
+		t.Errorf("Calling c.SetDialNetwork(%q) failed", "tcp6")
+	}
+	c.SetDialNetwork("udp")
+	if c.network != "tcp6" {
+		t.Errorf("Preventing invalid values in c.SetDialNetwork(%q) failed", "udp")
+	}
+	for _, addr := range []string{"/var/lib/ms/ms.sock", "unix:/var/lib/ms/ms.sock"} {
+		if c, e = NewClient(addr); e != nil {
+			t.Errorf("An error should not be returned for %q: %s", addr, e)
+		} else {
+			if c.network != "unix" {
+				t.Errorf("Got %q want %q", c.network, "unix")
+			}
+			if c.address != "/var/lib/ms/ms.sock" {
+				t.Errorf("Got %q want %q", c.address, "/var/lib/ms/ms.sock")
+			}
+		}
+	}
+	if _, e = NewClient("unix:"); e == nil {
 		t.Errorf("An error should be returned")
 	}
 	if _, e = NewClient("fe80::879:d85f:f836:1b56%en1"); e == nil {
@@ -123,363 +265,4054 @@ func TestBasics(t *testing.T) {
 			t.Errorf("Got %q want %q", e, expect)
 		}
 	}
+	for _, addr := range []string{"[fe80::879:d85f:f836:1b56%en1]:10200", "[::1]:10200"} {
+		if c, e = NewClient(addr); e != nil {
+			t.Errorf("An error should not be returned for %q: %s", addr, e)
+		} else if c.address != addr {
+			t.Errorf("Got %q want %q", c.address, addr)
+		}
+	}
 }
 
-func TestGetFiles(t *testing.T) {
+func TestConfig(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	expected := ClientConfig{
+		Address:     address,
+		Network:     "tcp",
+		ConnTimeout: DefaultConnTimeout,
+		ConnSleep:   DefaultConnSleep,
+		CmdTimeout:  DefaultCmdTimeout,
+	}
+	if cfg := c.Config(); cfg != expected {
+		t.Errorf("Got %+v want %+v", cfg, expected)
+	}
+	c.SetConnTimeout(2 * time.Second)
+	c.SetConnRetries(3)
+	c.SetStreamTimeout(time.Minute)
+	c.SetTotalDialTimeout(10 * time.Second)
+	expected.ConnTimeout = 2 * time.Second
+	expected.ConnRetries = 3
+	expected.StreamTimeout = time.Minute
+	expected.TotalDialTimeout = 10 * time.Second
+	ctx := context.Background()
+	defer c.Close(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.ScanReader(ctx, strings.NewReader(eicarVirus))
+	}()
+	if cfg := c.Config(); cfg != expected {
+		t.Errorf("Got %+v want %+v", cfg, expected)
+	}
+	<-done
+}
+
+func TestEffectiveDeadline(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned")
+	}
+	c.SetCmdTimeout(1 * time.Minute)
+	d := c.effectiveDeadline(context.Background())
+	if d.Before(time.Now().Add(59 * time.Second)) {
+		t.Errorf("The cmd timeout should be used when the context has no deadline")
+	}
+	expected := time.Now().Add(30 * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), expected)
+	defer cancel()
+	if d = c.effectiveDeadline(ctx); !d.Equal(expected) {
+		t.Errorf("Got %s want %s", d, expected)
+	}
+	c.SetCmdTimeout(1 * time.Second)
+	if d = c.effectiveDeadline(ctx); !d.Before(expected) {
+		t.Errorf("The cmd timeout should be used when it is earlier than the context deadline")
+	}
+}
+
+func TestDialUnix(t *testing.T) {
 	dir, e := ioutil.TempDir("", "")
 	if e != nil {
 		t.Fatalf("Temp directory creation failed")
 	}
 	defer os.RemoveAll(dir)
-	if e = os.Chmod(dir, 0755); e != nil {
-		t.Errorf("Temp directory chmod failed")
+	sock := path.Join(dir, "fpscand.sock")
+	l, e := net.Listen("unix", sock)
+	if e != nil {
+		t.Fatalf("Unix socket listen failed: %s", e)
 	}
-	// cm := map[string]bool{}
-	pts := []string{path.Join(dir, "file1.txt"), path.Join(dir, "file2.txt")}
-	content := []byte("temporary file's content")
-	for _, fn := range pts {
-		e = ioutil.WriteFile(fn, content, 0640)
-		if e != nil {
-			t.Errorf("Temp directory chmod failed")
-			continue
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
 		}
-		// cm[fn] = true
-		defer os.Remove(fn)
+	}()
+	c, e := NewClient(sock)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
 	}
-	fls, e := getFiles(dir)
-	found := len(fls)
-	if found != 2 {
-		t.Errorf("Calling getFiles(%q) should return %q got %q", dir, 2, found)
+	conn, e := c.dial(context.Background())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
 	}
-	if fls[0] != pts[0] && fls[1] != pts[1] {
-		t.Errorf("Files returned do not match created")
+	conn.Close()
+}
+
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
+
+type testFailDialer struct {
+	err   error
+	calls int32
+}
+
+func (d *testFailDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return nil, d.err
+}
+
+func TestBackoff(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
 	}
-	_, e = getFiles("/tmxts/hylsgxut.2s.sas")
-	if e == nil {
-		t.Errorf("An error should be returned")
+	if d := c.retrySleep(3); d != DefaultConnSleep {
+		t.Errorf("Got %s want %s", d, DefaultConnSleep)
 	}
-	gopath := os.Getenv("GOPATH")
-	if gopath == "" {
-		gopath = build.Default.GOPATH
+	c.SetBackoff(time.Second, time.Millisecond, 2)
+	if c.backoffBase != 0 {
+		t.Errorf("A maximum below the base should be ignored")
 	}
-	fn := path.Join(gopath, "src/github.com/baruwa-enterprise/fprot/README.md")
-	_, e = getFiles(fn)
-	if e == nil {
-		t.Errorf("An error should be returned")
+	c.SetBackoff(time.Second, time.Second, 0.5)
+	if c.backoffBase != 0 {
+		t.Errorf("A factor below 1 should be ignored")
 	}
-}
-
-func TestScan(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		fn := "/var/spool/testfiles/install.log"
-		s, e := c.ScanFile(ctx, fn)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		if len(s) != 1 {
-			t.Fatalf("Expected 1 got %d", len(s))
-		}
-		if s[0].Filename != fn {
-			t.Fatalf("Filename expected %s got %s", fn, s[0].Filename)
-		}
-		if s[0].Infected {
-			t.Fatalf("Infected expected %t got %t", false, s[0].Infected)
-		}
-		if s[0].Signature != "" {
-			t.Fatalf("Filename expected %s got %s", "", s[0].Signature)
-		}
-		fn = "/var/spool/testfiles/eicar.txt"
-		s, e = c.ScanFile(ctx, fn)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		if len(s) != 1 {
-			t.Fatalf("Expected 1 got %d", len(s))
-		}
-		if s[0].Filename != fn {
-			t.Fatalf("Filename expected %s got %s", fn, s[0].Filename)
-		}
-		if !s[0].Infected {
-			t.Fatalf("Infected expected %t got %t", true, s[0].Infected)
+	c.SetBackoff(100*time.Millisecond, time.Second, 2)
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, want := range expected {
+		if got := c.backoff(i + 1); got != want {
+			t.Errorf("attempt %d: got %s want %s", i+1, got, want)
 		}
-		if s[0].Signature != "EICAR_Test_File" {
-			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", s[0].Signature)
+		if got := c.retrySleep(i + 1); got < want/2 || got > want {
+			t.Errorf("attempt %d: %s is not within [%s, %s]", i+1, got, want/2, want)
 		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+	}
+	c.SetBackoff(0, 0, 0)
+	if d := c.retrySleep(3); d != DefaultConnSleep {
+		t.Errorf("Got %s want %s", d, DefaultConnSleep)
 	}
 }
 
-func TestScanFiles(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		fns := []string{
-			"/var/spool/testfiles/eicar.txt",
-			"/var/spool/testfiles/eicar.tar.bz2",
-		}
-		s, e := c.ScanFiles(ctx, fns[0], fns[1])
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		if len(s) != len(fns) {
-			t.Fatalf("Expected %d got %d", len(fns), len(s))
-		}
-		for _, r := range s {
-			if r.Filename != fns[0] && r.Filename != fns[1] {
-				t.Fatalf("Filename expected %s or %s got %s", fns[0], fns[1], r.Filename)
-			}
-			if !r.Infected {
-				t.Fatalf("Infected expected %t got %t", true, r.Infected)
-			}
-			if r.Signature != "EICAR_Test_File" {
-				t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
-			}
-		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
-	}
-}
-
-// func TestScanDir(t *testing.T) {
-// 	address := os.Getenv("FPROT_ADDRESS")
-// 	if address != "" {
-// 		c, e := NewClient(address)
-// 		if e != nil {
-// 			t.Fatalf("Error should not be returned: %s", e)
-// 		}
-// 		defer c.Close()
-// 		s, e := c.ScanDir("/var/spool/testfiles")
-// 		if e != nil {
-// 			t.Fatalf("Error should not be returned: %s", e)
-// 		}
-// 		if len(s) == 0 {
-// 			t.Fatalf("Expected > 1 got %d", len(s))
-// 		}
-// 	}
-// }
+func TestSetLocalAddr(t *testing.T) {
+	accepted := make(chan net.Addr, 1)
+	address, stop := testConnServer(t, func(conn net.Conn) {
+		accepted <- conn.RemoteAddr()
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	local := l.Addr().(*net.TCPAddr)
+	l.Close()
+	c.SetLocalAddr(local)
+	c.SetDialer(&net.Dialer{})
+	conn, e := c.dialOnce(context.Background())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer conn.Close()
+	if got := conn.LocalAddr().String(); got != local.String() {
+		t.Errorf("Got %q want %q", got, local.String())
+	}
+	if got := (<-accepted).String(); got != local.String() {
+		t.Errorf("Got %q want %q", got, local.String())
+	}
+}
 
-func TestScanDirStream(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		gopath := os.Getenv("GOPATH")
-		if gopath == "" {
-			gopath = build.Default.GOPATH
-		}
-		dn := path.Join(gopath, "src/github.com/baruwa-enterprise/fprot/examples/data")
-		s, e := c.ScanDirStream(ctx, dn)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		for _, r := range s {
-			if !r.Infected {
-				t.Fatalf("Infected expected %t got %t", true, r.Infected)
-			}
-			if r.Signature != "EICAR_Test_File" {
-				t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
-			}
-		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+func TestDialCancel(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	d := &testFailDialer{err: testTimeoutError{}}
+	c.SetDialer(d)
+	c.SetConnRetries(3)
+	c.SetConnSleep(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if e = c.Dial(ctx); e != context.Canceled {
+		t.Errorf("Got %v want %v", e, context.Canceled)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("The retry sleep should be interrupted by the context")
+	}
+	if n := atomic.LoadInt32(&d.calls); n != 1 {
+		t.Errorf("Expected 1 dial attempt got %d", n)
 	}
 }
 
-func TestScanStream(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		gopath := os.Getenv("GOPATH")
-		if gopath == "" {
-			gopath = build.Default.GOPATH
-		}
-		fn := path.Join(gopath, "src/github.com/baruwa-enterprise/fprot/examples/data/eicar.tar.bz2")
-		s, e := c.ScanStream(ctx, fn)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		for _, r := range s {
-			if !r.Infected {
-				t.Fatalf("Infected expected %t got %t", true, r.Infected)
-			}
-			if r.Signature != "EICAR_Test_File" {
-				t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
-			}
-		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+type testRefusedDialer struct {
+	refused int
+	calls   int
+	d       net.Dialer
+}
+
+func (d *testRefusedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.calls++
+	if d.calls <= d.refused {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
 	}
+	return d.d.DialContext(ctx, network, address)
 }
 
-func TestScanReader(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		gopath := os.Getenv("GOPATH")
-		if gopath == "" {
-			gopath = build.Default.GOPATH
-		}
-		fn := path.Join(gopath, "src/github.com/baruwa-enterprise/fprot/examples/data/eicar.tar.bz2")
-		f, e := os.Open(fn)
-		if e != nil {
-			t.Fatalf("Failed to open file: %s", fn)
-		}
-		defer f.Close()
-		s, e := c.ScanReader(ctx, f)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		for _, r := range s {
-			if !r.Infected {
-				t.Fatalf("Infected expected %t got %t", true, r.Infected)
-			}
-			if r.Signature != "EICAR_Test_File" {
-				t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
-			}
-		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+type testHangDialer struct {
+	calls int32
+}
+
+func (d *testHangDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.calls, 1)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTotalDialTimeout(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	d := &testHangDialer{}
+	c.SetDialer(d)
+	c.SetConnTimeout(100 * time.Millisecond)
+	c.SetConnRetries(2)
+	c.SetConnSleep(10 * time.Millisecond)
+	ctx := context.Background()
+	if e = c.Dial(ctx); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	if n := atomic.LoadInt32(&d.calls); n != 3 {
+		t.Errorf("Expected 3 got %d", n)
+	}
+	d = &testHangDialer{}
+	c.SetDialer(d)
+	c.SetConnTimeout(time.Second)
+	c.SetConnRetries(10)
+	c.SetTotalDialTimeout(-1)
+	if c.totalDialTimeout != 0 {
+		t.Errorf("Calling c.SetTotalDialTimeout(-1) should be ignored")
+	}
+	c.SetTotalDialTimeout(200 * time.Millisecond)
+	start := time.Now()
+	if e = c.Dial(ctx); e != context.DeadlineExceeded {
+		t.Errorf("Got %v want %v", e, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("The dial should be bounded by the total timeout took %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&d.calls); n != 1 {
+		t.Errorf("Expected 1 got %d", n)
 	}
 }
 
-func TestScanReaderBytes(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		m := []byte(eicarVirus)
-		f := bytes.NewReader(m)
-		s, e := c.ScanReader(ctx, f)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		for _, r := range s {
-			if !r.Infected {
-				t.Fatalf("Infected expected %t got %t", true, r.Infected)
-			}
-			if r.Signature != "EICAR_Test_File" {
-				t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
-			}
-		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+func TestDialRetryRefused(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	d := &testRefusedDialer{refused: 2}
+	c.SetDialer(d)
+	c.SetConnRetries(2)
+	c.SetConnSleep(10 * time.Millisecond)
+	ctx := context.Background()
+	if e = c.Dial(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.discard()
+	if d.calls != 3 {
+		t.Errorf("Expected 3 got %d", d.calls)
+	}
+	errCustom := errors.New("custom")
+	fd := &testFailDialer{err: errCustom}
+	c.SetDialer(fd)
+	if e = c.Dial(ctx); e != errCustom {
+		t.Errorf("Got %v want %v", e, errCustom)
+	}
+	if fd.calls != 1 {
+		t.Errorf("Expected 1 got %d", fd.calls)
+	}
+	fd.calls = 0
+	c.SetRetryableErrors(func(err error) bool {
+		return err == errCustom
+	})
+	if e = c.Dial(ctx); e != errCustom {
+		t.Errorf("Got %v want %v", e, errCustom)
+	}
+	if fd.calls != 3 {
+		t.Errorf("Expected 3 got %d", fd.calls)
 	}
 }
 
-func TestScanReaderBuffer(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		f := bytes.NewBufferString(eicarVirus)
-		s, e := c.ScanReader(ctx, f)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		for _, r := range s {
-			if !r.Infected {
-				t.Fatalf("Infected expected %t got %t", true, r.Infected)
-			}
-			if r.Signature != "EICAR_Test_File" {
-				t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+func TestDial(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Listen failed: %s", e)
+	}
+	address := l.Addr().String()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
 			}
+			accepted <- conn
 		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+	}()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	if e = c.Dial(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	conn := c.conn
+	if e = c.Dial(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.conn != conn {
+		t.Errorf("The existing connection should be reused")
+	}
+	c.conn.Close()
+	(<-accepted).Close()
+	l.Close()
+	c, e = NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = c.Dial(ctx); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if c.tc != nil {
+		t.Errorf("The connection should not be set on failure")
 	}
 }
 
-func TestScanReaderString(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		f := strings.NewReader(eicarVirus)
-		s, e := c.ScanReader(ctx, f)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		for _, r := range s {
-			if !r.Infected {
-				t.Fatalf("Infected expected %t got %t", true, r.Infected)
-			}
-			if r.Signature != "EICAR_Test_File" {
-				t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
-			}
-		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+func TestReadBufferSize(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.readBufSize != defaultReadBufSize {
+		t.Errorf("The default read buffer size should be set")
+	}
+	c.SetReadBufferSize(minReadBufSize - 1)
+	if c.readBufSize != defaultReadBufSize {
+		t.Errorf("Calling c.SetReadBufferSize(%d) should be ignored", minReadBufSize-1)
+	}
+	c.SetReadBufferSize(65536)
+	ctx := context.Background()
+	defer c.Close(ctx)
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.tc.R.Size() != 65536 {
+		t.Errorf("Got %d want %d", c.tc.R.Size(), 65536)
 	}
 }
 
-func TestInfo(t *testing.T) {
-	address := os.Getenv("FPROT_ADDRESS")
-	if address != "" {
-		c, e := NewClient(address)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		ctx := context.Background()
-		defer c.Close(ctx)
-		i, e := c.Info(ctx)
-		if e != nil {
-			t.Fatalf("Error should not be returned: %s", e)
-		}
-		if i.Engine == "" {
-			t.Errorf("i.Engine should be none empty string")
-		}
-		if i.Version == "" {
-			t.Errorf("i.Version should be none empty string")
-		}
-		if i.Protocol == "" {
-			t.Errorf("i.Protocol should be none empty string")
-		}
-		if i.Signature == "" {
-			t.Errorf("i.Signature should be none empty string")
-		}
-		if i.Uptime == "" {
-			t.Errorf("i.Uptime should be none empty string")
-		}
-	} else {
-		t.Skip("skipping test; $FPROT_ADDRESS not set")
+func TestWriteBufferSize(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.writeBufSize != defaultWriteBufSize {
+		t.Errorf("The default write buffer size should be set")
+	}
+	c.SetWriteBufferSize(minWriteBufSize - 1)
+	if c.writeBufSize != defaultWriteBufSize {
+		t.Errorf("Calling c.SetWriteBufferSize(%d) should be ignored", minWriteBufSize-1)
+	}
+	c.SetWriteBufferSize(65536)
+	ctx := context.Background()
+	defer c.Close(ctx)
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.tc.W.Size() != 65536 {
+		t.Errorf("Got %d want %d", c.tc.W.Size(), 65536)
+	}
+	s, e := c.ScanFiles(ctx, path.Join("examples", "data", "eicar.txt"), path.Join("examples", "data", "eicar.tar.bz2"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 2 {
+		t.Errorf("Expected 2 got %d", len(s))
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetIdleTimeout(50 * time.Millisecond)
+	ctx := context.Background()
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	time.Sleep(200 * time.Millisecond)
+	c.m.Lock()
+	closed := c.tc == nil
+	c.m.Unlock()
+	if !closed {
+		t.Errorf("The idle connection should be closed")
+	}
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = c.Close(ctx); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if c.reaper != nil {
+		t.Errorf("The reaper should be stopped on Close")
+	}
+}
+
+type testDialer struct {
+	d         net.Dialer
+	addresses []string
+}
+
+func (d *testDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.addresses = append(d.addresses, address)
+	return d.d.DialContext(ctx, network, address)
+}
+
+func TestSetDialer(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	d := &testDialer{}
+	c.SetDialer(d)
+	ctx := context.Background()
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(d.addresses) != 1 || d.addresses[0] != address {
+		t.Errorf("Got %q want %q", d.addresses, []string{address})
+	}
+	c.discard()
+	nd := &net.Dialer{}
+	c.SetDialer(nd)
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if nd.Timeout != 0 {
+		t.Errorf("The supplied dialer should not be modified")
+	}
+}
+
+func testTLSConfig(t *testing.T) (cfg *tls.Config) {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatalf("Key generation failed: %s", e)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if e != nil {
+		t.Fatalf("Certificate creation failed: %s", e)
+	}
+	cfg = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	return
+}
+
+func TestDialTLS(t *testing.T) {
+	l, e := tls.Listen("tcp", "127.0.0.1:0", testTLSConfig(t))
+	if e != nil {
+		t.Fatalf("TLS listen failed: %s", e)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	c, e := NewClient(l.Addr().String())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	conn, e := c.dial(context.Background())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer conn.Close()
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		t.Fatalf("A TLS connection should be returned got %T", conn)
+	}
+	if !tc.ConnectionState().HandshakeComplete {
+		t.Errorf("The TLS handshake should be complete")
+	}
+	if _, e = conn.Write([]byte("HELP\n")); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	b := make([]byte, 5)
+	if _, e = io.ReadFull(conn, b); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if string(b) != "HELP\n" {
+		t.Errorf("Got %q want %q", b, "HELP\n")
+	}
+}
+
+func TestStreamChunkSize(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned")
+	}
+	if c.streamChunkSize != DefaultChunkSize {
+		t.Errorf("The default stream chunk size should be set")
+	}
+	c.SetStreamChunkSize(100)
+	if c.streamChunkSize != DefaultChunkSize {
+		t.Errorf("Preventing values below the minimum in c.SetStreamChunkSize(%d) failed", 100)
+	}
+	c.SetStreamChunkSize(4096)
+	if c.streamChunkSize != 4096 {
+		t.Errorf("Calling c.SetStreamChunkSize(%d) failed", 4096)
+	}
+	c.SetStreamChunkSize(minChunkSize)
+	content := bytes.Repeat([]byte(eicarVirus), 50)
+	w := &testChunkWriter{}
+	n, e := c.copyStream(w, bytes.NewReader(content))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if n != int64(len(content)) {
+		t.Errorf("Got %d want %d", n, len(content))
+	}
+	if !bytes.Equal(w.buf.Bytes(), content) {
+		t.Errorf("The copied content does not match")
+	}
+	if w.max != minChunkSize {
+		t.Errorf("Got %d want %d", w.max, minChunkSize)
+	}
+}
+
+func BenchmarkScanStream(b *testing.B) {
+	address, stop := testServer(b, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		b.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, e = c.ScanReader(ctx, strings.NewReader(eicarVirus)); e != nil {
+			b.Fatalf("An error should not be returned: %s", e)
+		}
+	}
+}
+
+func BenchmarkScanDir(b *testing.B) {
+	address, stop := testServer(b, testScanHandler)
+	defer stop()
+	for _, n := range []int{10, 100, 1000} {
+		dir, e := ioutil.TempDir("", "")
+		if e != nil {
+			b.Fatalf("Temp directory creation failed")
+		}
+		defer os.RemoveAll(dir)
+		for i := 0; i < n; i++ {
+			if e = ioutil.WriteFile(path.Join(dir, fmt.Sprintf("file%d.txt", i)), []byte(eicarVirus), 0640); e != nil {
+				b.Fatalf("Temp file creation failed")
+			}
+		}
+		for _, tt := range []struct {
+			name string
+			scan func(context.Context, *Client) ([]*Response, error)
+		}{
+			{"ScanDir", func(ctx context.Context, c *Client) ([]*Response, error) {
+				return c.ScanDir(ctx, dir)
+			}},
+			{"ScanDirStream", func(ctx context.Context, c *Client) ([]*Response, error) {
+				return c.ScanDirStream(ctx, dir)
+			}},
+			{"ScanDirParallel", func(ctx context.Context, c *Client) ([]*Response, error) {
+				return c.ScanDirParallel(ctx, dir, 4)
+			}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", tt.name, n), func(b *testing.B) {
+				c, e := NewClient(address)
+				if e != nil {
+					b.Fatalf("An error should not be returned: %s", e)
+				}
+				ctx := context.Background()
+				defer c.Close(ctx)
+				b.ReportAllocs()
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					s, e := tt.scan(ctx, c)
+					if e != nil {
+						b.Fatalf("An error should not be returned: %s", e)
+					}
+					if len(s) != n {
+						b.Fatalf("Expected %d got %d", n, len(s))
+					}
+				}
+				b.ReportMetric(float64(n*b.N)/time.Since(start).Seconds(), "files/s")
+			})
+		}
+	}
+}
+
+type testChunkWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *testChunkWriter) Write(b []byte) (int, error) {
+	if len(b) > w.max {
+		w.max = len(b)
+	}
+	return w.buf.Write(b)
+}
+
+func TestSpoolReader(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned")
+	}
+	if c.maxInMemory != defaultMaxInMemory {
+		t.Errorf("The default max in memory should be set")
+	}
+	c.SetMaxInMemory(-1)
+	if c.maxInMemory != defaultMaxInMemory {
+		t.Errorf("Preventing negative values in c.SetMaxInMemory(%d) failed", -1)
+	}
+	c.SetMaxInMemory(int64(len(eicarVirus)))
+	r, n, cleanup, e := c.spoolReader(io.MultiReader(strings.NewReader(eicarVirus)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if n != int64(len(eicarVirus)) {
+		t.Errorf("Got %d want %d", n, len(eicarVirus))
+	}
+	if _, ok := r.(*bytes.Buffer); !ok {
+		t.Errorf("Content within the limit should be buffered in memory got %T", r)
+	}
+	cleanup()
+	c.SetMaxInMemory(10)
+	r, n, cleanup, e = c.spoolReader(io.MultiReader(strings.NewReader(eicarVirus)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer cleanup()
+	if n != int64(len(eicarVirus)) {
+		t.Errorf("Got %d want %d", n, len(eicarVirus))
+	}
+	f, ok := r.(*os.File)
+	if !ok {
+		t.Fatalf("Content over the limit should be buffered to a file got %T", r)
+	}
+	b, e := ioutil.ReadAll(f)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if string(b) != eicarVirus {
+		t.Errorf("Got %q want %q", b, eicarVirus)
+	}
+	cleanup()
+	if _, e = os.Stat(f.Name()); !os.IsNotExist(e) {
+		t.Errorf("The temporary file should be removed")
+	}
+}
+
+func testServer(t testing.TB, handler func(*textproto.Conn)) (address string, stop func()) {
+	address, stop = testConnServer(t, func(conn net.Conn) {
+		tc := textproto.NewConn(conn)
+		defer tc.Close()
+		handler(tc)
+	})
+	return
+}
+
+func testConnServer(t testing.TB, handler func(net.Conn)) (address string, stop func()) {
+	address, stop, e := mockServer(handler)
+	if e != nil {
+		t.Fatalf("Listen failed: %s", e)
+	}
+	return
+}
+
+// mockServer starts a local fpscand server that serves each
+// connection with handler, stop closes the listener
+func mockServer(handler func(net.Conn)) (address string, stop func(), err error) {
+	var l net.Listener
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	address = l.Addr().String()
+	stop = func() {
+		l.Close()
+	}
+	return
+}
+
+// mockScanServer starts a local fpscand server that serves
+// each connection with testScanHandler
+func mockScanServer() (address string, stop func(), err error) {
+	address, stop, err = mockServer(func(conn net.Conn) {
+		tc := textproto.NewConn(conn)
+		defer tc.Close()
+		testScanHandler(tc)
+	})
+	return
+}
+
+// testWriteLine writes a newline terminated line the way
+// fpscand does, textproto.PrintfLine uses CRLF
+func testWriteLine(tc *textproto.Conn, format string, args ...interface{}) {
+	fmt.Fprintf(tc.W, format+"\n", args...)
+	tc.W.Flush()
+}
+
+func testScanHandler(tc *textproto.Conn) {
+	var name, resp string
+	var size int64
+	var b []byte
+	var queue bool
+	var queued []string
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		switch {
+		case line == "HELP":
+			testWriteLine(tc, "%s", testBanner)
+			testWriteLine(tc, "")
+			continue
+		case line == "QUEUE":
+			queue = true
+			continue
+		case line == "SCAN":
+			for _, resp = range queued {
+				testWriteLine(tc, "%s", resp)
+			}
+			queue = false
+			queued = nil
+			continue
+		case strings.HasPrefix(line, "SCAN STREAM "):
+			if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+				return
+			}
+			b = make([]byte, size)
+			if _, err = io.ReadFull(tc.R, b); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "SCAN FILE "):
+			name = strings.TrimPrefix(line, "SCAN FILE ")
+			if b, err = ioutil.ReadFile(name); err != nil {
+				b = nil
+			}
+		default:
+			return
+		}
+		switch {
+		case b == nil:
+			resp = fmt.Sprintf("64 <skipped> %s", name)
+		case testInfected(b):
+			resp = fmt.Sprintf("1 <infected: EICAR_Test_File> %s", name)
+		default:
+			resp = fmt.Sprintf("0 <clean> %s", name)
+		}
+		if queue {
+			queued = append(queued, resp)
+		} else {
+			testWriteLine(tc, "%s", resp)
+		}
+	}
+}
+
+// testInfected returns true if b contains the EICAR test
+// string, bzip2 compressed content is decompressed first
+func testInfected(b []byte) bool {
+	if bytes.HasPrefix(b, []byte("BZh")) {
+		if d, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(b))); err == nil {
+			b = d
+		}
+	}
+	return bytes.Contains(b, []byte(eicarVirus))
+}
+
+// testFprotServer returns the address of the server in
+// $FPROT_ADDRESS and the directory holding its test files,
+// if it is not set the mock server is started and the test
+// files are created in a temporary directory
+func testFprotServer(t *testing.T) (address, dir string, stop func()) {
+	if address = os.Getenv("FPROT_ADDRESS"); address != "" {
+		dir = "/var/spool/testfiles"
+		stop = func() {}
+		return
+	}
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	for _, n := range []string{"eicar.txt", "eicar.tar.bz2"} {
+		b, e := ioutil.ReadFile(path.Join("examples", "data", n))
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if e = ioutil.WriteFile(path.Join(dir, n), b, 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	if e = ioutil.WriteFile(path.Join(dir, "install.log"), []byte("clean"), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	address, sstop := testServer(t, testScanHandler)
+	stop = func() {
+		sstop()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+func TestScanReaderWithSize(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	s, e := c.ScanReaderWithSize(ctx, io.MultiReader(strings.NewReader(eicarVirus)), int64(len(eicarVirus)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 {
+		t.Fatalf("Expected 1 got %d", len(s))
+	}
+	if !s[0].Infected {
+		t.Errorf("Infected expected %t got %t", true, s[0].Infected)
+	}
+	if s[0].Signature != "EICAR_Test_File" {
+		t.Errorf("Signature expected %s got %s", "EICAR_Test_File", s[0].Signature)
+	}
+	_, e = c.ScanReaderWithSize(ctx, strings.NewReader(eicarVirus), int64(len(eicarVirus)+10))
+	if e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	expect := fmt.Sprintf(shortStreamErr, len(eicarVirus), len(eicarVirus)+10)
+	if e.Error() != expect {
+		t.Errorf("Got %q want %q", e, expect)
+	}
+	if c.tc != nil {
+		t.Errorf("The connection should be discarded after a short stream")
+	}
+	if _, e = c.ScanReaderWithSize(ctx, strings.NewReader(eicarVirus), -1); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestScanArchiveMembers(t *testing.T) {
+	members := []struct {
+		name    string
+		content string
+	}{
+		{"docs/readme.txt", "clean content"},
+		{"bin/eicar.com", eicarVirus},
+	}
+	var tb, zb bytes.Buffer
+	tw := tar.NewWriter(&tb)
+	zw := zip.NewWriter(&zb)
+	if e := tw.WriteHeader(&tar.Header{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755}); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e := zw.Create("docs/"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	for _, m := range members {
+		if e := tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.content))}); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		tw.Write([]byte(m.content))
+		w, e := zw.Create(m.name)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		w.Write([]byte(m.content))
+	}
+	tw.Close()
+	zw.Close()
+	var gb bytes.Buffer
+	gw := gzip.NewWriter(&gb)
+	gw.Write(tb.Bytes())
+	gw.Close()
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	for _, tt := range []struct {
+		format string
+		r      io.Reader
+	}{
+		{"tar", bytes.NewReader(tb.Bytes())},
+		{"tgz", bytes.NewReader(gb.Bytes())},
+		{"zip", bytes.NewReader(zb.Bytes())},
+		{"ZIP", io.MultiReader(bytes.NewReader(zb.Bytes()))},
+	} {
+		m, e := c.ScanArchiveMembers(ctx, tt.r, tt.format)
+		if e != nil {
+			t.Fatalf("%s: an error should not be returned: %s", tt.format, e)
+		}
+		if len(m) != len(members) {
+			t.Fatalf("%s: expected %d got %d", tt.format, len(members), len(m))
+		}
+		for _, mb := range members {
+			rs := m[mb.name]
+			if len(rs) != 1 || rs[0].Filename != mb.name {
+				t.Errorf("%s: unexpected responses for %s: %v", tt.format, mb.name, rs)
+				continue
+			}
+			if rs[0].Infected != (mb.content == eicarVirus) {
+				t.Errorf("%s: %s Infected got %t", tt.format, mb.name, rs[0].Infected)
+			}
+		}
+	}
+	if _, e = c.ScanArchiveMembers(ctx, bytes.NewReader(tb.Bytes()), "rar"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if _, e = c.ScanArchiveMembers(ctx, strings.NewReader("not a zip"), "zip"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	// The scan timeout bounds the archive
+	address, stop = testServer(t, func(tc *textproto.Conn) {
+		io.Copy(ioutil.Discard, tc.R)
+	})
+	defer stop()
+	if c, e = NewClient(address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close(ctx)
+	c.SetScanTimeout(100 * time.Millisecond)
+	start := time.Now()
+	if _, e = c.ScanArchiveMembers(ctx, bytes.NewReader(tb.Bytes()), "tar"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if time.Since(start) >= 5*time.Second {
+		t.Errorf("The scan should time out")
+	}
+}
+
+func TestIsInfected(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	infected, sig, e := c.IsInfected(ctx, strings.NewReader(eicarVirus), int64(len(eicarVirus)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !infected || sig != "EICAR_Test_File" {
+		t.Errorf("Got %t %q want %t %q", infected, sig, true, "EICAR_Test_File")
+	}
+	infected, sig, e = c.IsInfected(ctx, strings.NewReader("clean"), 5)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if infected || sig != "" {
+		t.Errorf("Got %t %q want %t %q", infected, sig, false, "")
+	}
+	address, stop = testServer(t, func(tc *textproto.Conn) {
+		var name string
+		var size int64
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+			return
+		}
+		io.CopyN(ioutil.Discard, tc.R, size)
+		testWriteLine(tc, "64 <skipped> %s", name)
+	})
+	defer stop()
+	if c, e = NewClient(address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close(ctx)
+	if infected, _, e = c.IsInfected(ctx, strings.NewReader("clean"), 5); e == nil || infected {
+		t.Errorf("A skipped stream should return an error")
+	}
+	if _, ok := e.(*ScanError); !ok {
+		t.Errorf("Got %T want *ScanError", e)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if eicarTest != eicarVirus {
+		t.Fatalf("The EICAR test string does not match")
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	if e = c.SelfTest(ctx); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	address, stop = testServer(t, func(tc *textproto.Conn) {
+		var name string
+		var size int64
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+			return
+		}
+		io.CopyN(ioutil.Discard, tc.R, size)
+		testWriteLine(tc, "0 <clean> %s", name)
+	})
+	defer stop()
+	n, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer n.Close(ctx)
+	e = n.SelfTest(ctx)
+	if e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	expected := fmt.Sprintf(selfTestErr, "0 <clean> eicar.com")
+	if e.Error() != expected {
+		t.Errorf("Got %q want %q", e, expected)
+	}
+}
+
+func TestScanFileReader(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	s, e := c.ScanFileReader(ctx, "attachment1.eml", strings.NewReader(eicarVirus), int64(len(eicarVirus)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Fatalf("The stream should be infected got %v", s)
+	}
+	if s[0].Filename != "attachment1.eml" {
+		t.Errorf("Got %q want %q", s[0].Filename, "attachment1.eml")
+	}
+	for _, name := range []string{"", "bad\r\nQUIT"} {
+		if _, e = c.ScanFileReader(ctx, name, strings.NewReader(eicarVirus), int64(len(eicarVirus))); e == nil {
+			t.Errorf("An error should be returned for %q", name)
+		}
+	}
+}
+
+func TestScanStreamSpacedName(t *testing.T) {
+	for in, out := range map[string]string{
+		"file.txt":       "file.txt",
+		"my file.txt":    "my%20file.txt",
+		"tab\tfile":      "tab%09file",
+		"100%.txt":       "100%25.txt",
+		"my%20file.txt":  "my%2520file.txt",
+		"/a dir/b c.txt": "/a%20dir/b%20c.txt",
+	} {
+		if got := streamToken(in); got != out {
+			t.Errorf("streamToken(%q) = %q, want %q", in, got, out)
+		}
+	}
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	sub := path.Join(dir, "my documents")
+	if e = os.Mkdir(sub, 0755); e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	files := []string{path.Join(sub, "eicar test.txt"), path.Join(sub, "100% clean.txt")}
+	for i, fn := range files {
+		content := eicarVirus
+		if i > 0 {
+			content = "clean"
+		}
+		if e = ioutil.WriteFile(fn, []byte(content), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	s, e := c.ScanStream(ctx, files...)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 2 {
+		t.Fatalf("Expected 2 got %d", len(s))
+	}
+	s = orderResponses(files, s)
+	for _, rs := range s {
+		if rs.Bytes == 0 {
+			t.Errorf("%s: the bytes sent should be set", rs.Filename)
+		}
+	}
+	if s[0].Filename != files[0] || !s[0].Infected {
+		t.Errorf("Got %s infected %t", s[0].Filename, s[0].Infected)
+	}
+	if s[1].Filename != files[1] || s[1].Infected {
+		t.Errorf("Got %s infected %t", s[1].Filename, s[1].Infected)
+	}
+	s, e = c.ScanFileReader(ctx, "my attachment.eml", strings.NewReader(eicarVirus), int64(len(eicarVirus)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Filename != "my attachment.eml" {
+		t.Errorf("The original name should be returned got %v", s)
+	}
+}
+
+type testFailWriter struct{}
+
+func (testFailWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestResponseBytes(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	sizes := map[string]int{path.Join(dir, "file1"): 10, path.Join(dir, "file2"): 2000}
+	var files []string
+	for fn, size := range sizes {
+		if e = ioutil.WriteFile(fn, make([]byte, size), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+		files = append(files, fn)
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	s, e := c.ScanStream(ctx, files...)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 2 {
+		t.Fatalf("Expected 2 got %d", len(s))
+	}
+	for _, rt := range s {
+		if rt.Bytes != int64(sizes[rt.Filename]) {
+			t.Errorf("%s: got %d want %d", rt.Filename, rt.Bytes, sizes[rt.Filename])
+		}
+	}
+	if s, e = c.ScanReader(ctx, strings.NewReader(eicarVirus)); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Bytes != int64(len(eicarVirus)) {
+		t.Errorf("The streamed bytes should be set got %v", s)
+	}
+	if s, e = c.ScanFile(ctx, files[0]); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Bytes != 0 {
+		t.Errorf("The bytes should not be set for file scans got %v", s)
+	}
+}
+
+func TestScanOpenFile(t *testing.T) {
+	f, e := ioutil.TempFile("", "fprot")
+	if e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, e = f.WriteString(eicarVirus); e != nil {
+		t.Fatalf("Temp file write failed")
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	s, e := c.ScanOpenFile(context.Background(), f)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected || s[0].Filename != f.Name() {
+		t.Errorf("The file should be infected got %v", s)
+	}
+	if off, _ := f.Seek(0, io.SeekCurrent); off != int64(len(eicarVirus)) {
+		t.Errorf("The file offset should be unchanged got %d", off)
+	}
+}
+
+func TestScanPipe(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	for _, scan := range []func(*os.File) ([]*Response, error){
+		func(f *os.File) ([]*Response, error) {
+			return c.ScanReader(ctx, f)
+		},
+		func(f *os.File) ([]*Response, error) {
+			return c.ScanOpenFile(ctx, f)
+		},
+	} {
+		pr, pw, e := os.Pipe()
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		go func() {
+			pw.Write([]byte(eicarVirus))
+			pw.Close()
+		}()
+		s, e := scan(pr)
+		pr.Close()
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(s) != 1 || !s[0].Infected {
+			t.Errorf("The piped content should be scanned got %v", s)
+		}
+		if len(s) == 1 && s[0].Bytes != int64(len(eicarVirus)) {
+			t.Errorf("Got %d want %d", s[0].Bytes, len(eicarVirus))
+		}
+	}
+}
+
+func TestScanFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"mail/eicar.com":    {Data: []byte(eicarVirus)},
+		"mail/clean.txt":    {Data: []byte("clean content")},
+		"mail/sub/note.txt": {Data: []byte("clean content")},
+		"other/skip.txt":    {Data: []byte("clean content")},
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	s, e := c.ScanFS(context.Background(), fsys, "mail")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 3 {
+		t.Fatalf("Expected 3 got %d", len(s))
+	}
+	for _, rt := range s {
+		if _, ok := fsys[rt.Filename]; !ok {
+			t.Errorf("The filename should be the path within the FS got %q", rt.Filename)
+		}
+		if rt.Infected != (rt.Filename == "mail/eicar.com") {
+			t.Errorf("%s: infected %t", rt.Filename, rt.Infected)
+		}
+	}
+	if _, e = c.ScanFS(context.Background(), fsys, "missing"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	// The directory filters apply
+	c.SetMaxDepth(0)
+	c.SetExcludeGlobs([]string{"clean.*"})
+	c.SetMaxFileSize(10)
+	if s, e = c.ScanFS(context.Background(), fsys, "mail"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Filename != "mail/eicar.com" || s[0].Status != oversizeStatus {
+		t.Errorf("Only the oversized eicar.com should be returned got %v", s)
+	}
+}
+
+func TestScanStreamReader(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	var b bytes.Buffer
+	s, e := c.ScanStreamReader(ctx, strings.NewReader(eicarVirus), int64(len(eicarVirus)), &b)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Errorf("The stream should be infected got %v", s)
+	}
+	if b.String() != eicarVirus {
+		t.Errorf("Got %q want %q", b.String(), eicarVirus)
+	}
+	if _, e = c.ScanStreamReader(ctx, strings.NewReader(eicarVirus), int64(len(eicarVirus)), testFailWriter{}); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if c.tc != nil {
+		t.Errorf("The connection should be discarded after a failed stream")
+	}
+}
+
+type testSizedReader struct {
+	io.Reader
+	size int64
+}
+
+func TestContentLengthFunc(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	var calls int
+	c.SetContentLengthFunc(func(r io.Reader) (int64, bool) {
+		calls++
+		if v, ok := r.(*testSizedReader); ok {
+			return v.size, true
+		}
+		return 0, false
+	})
+	ctx := context.Background()
+	readers := []io.Reader{
+		&testSizedReader{Reader: strings.NewReader(eicarVirus + "trailing"), size: int64(len(eicarVirus))},
+		io.MultiReader(strings.NewReader(eicarVirus)),
+	}
+	for _, r := range readers {
+		s, e := c.ScanReader(ctx, r)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(s) != 1 || !s[0].Infected {
+			t.Errorf("The stream should be infected got %v", s)
+		}
+	}
+	if calls != len(readers) {
+		t.Errorf("Expected %d got %d", len(readers), calls)
+	}
+}
+
+func TestSendStream(t *testing.T) {
+	received := make(chan string, 1)
+	c := testPipeClient(t, func(conn net.Conn) {
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	})
+	ctx := context.Background()
+	n, e := c.sendStream(ctx, "file", strings.NewReader("content that grew"), 7)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if n != 7 {
+		t.Errorf("Expected 7 got %d", n)
+	}
+	if _, e = c.sendStream(ctx, "file", strings.NewReader("short"), 10); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	if e.Error() != fmt.Sprintf(shortStreamErr, 5, 10) {
+		t.Errorf("Got %q want %q", e, fmt.Sprintf(shortStreamErr, 5, 10))
+	}
+	c.tc.W.Flush()
+	c.tc.Close()
+	expected := "SCAN STREAM file SIZE 7\r\ncontentSCAN STREAM file SIZE 10\r\nshort"
+	if got := <-received; got != expected {
+		t.Errorf("Got %q want %q", got, expected)
+	}
+}
+
+func TestStreamRejected(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		if _, err := tc.ReadLine(); err != nil {
+			return
+		}
+		// Reject the size and stop reading the content
+		testWriteLine(tc, "ERROR: stream too large")
+		<-done
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("a"), 32*1024*1024)
+	start := time.Now()
+	_, e = c.ScanReaderWithSize(ctx, bytes.NewReader(content), int64(len(content)))
+	if e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	expected := fmt.Sprintf(streamRejectedErr, "ERROR: stream too large")
+	if e.Error() != expected {
+		t.Errorf("Got %q want %q", e, expected)
+	}
+	if time.Since(start) >= 5*time.Second {
+		t.Errorf("The copy should be aborted once the stream is rejected")
+	}
+	if c.tc != nil {
+		t.Errorf("The connection should be discarded")
+	}
+}
+
+func TestStreamEarlyResponse(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		var name string
+		var size int64
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+			return
+		}
+		// A scan result is not a rejection of the stream
+		testWriteLine(tc, "1 <infected: EICAR_Test_File> %s", name)
+		io.CopyN(ioutil.Discard, tc.R, size)
+		tc.ReadLine()
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+	ctx := context.Background()
+	defer c.Close(ctx)
+	content := bytes.Repeat([]byte("a"), 8*1024*1024)
+	s, e := c.ScanReader(ctx, bytes.NewReader(content))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Errorf("The scan result should be returned got %v", s)
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		var name string
+		var size int64
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+			return
+		}
+		// Read the start of the content slowly
+		buf := make([]byte, 64*1024)
+		for i := 0; size > 0; i++ {
+			if i < 100 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			n, err := tc.R.Read(buf[:min64(size, int64(len(buf)))])
+			if err != nil {
+				return
+			}
+			size -= int64(n)
+		}
+		testWriteLine(tc, "0 <clean> %s", name)
+	})
+	defer stop()
+	content := bytes.Repeat([]byte("a"), 16*1024*1024)
+	ctx := context.Background()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(200 * time.Millisecond)
+	if _, e = c.ScanReaderWithSize(ctx, bytes.NewReader(content), int64(len(content))); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	c.SetStreamTimeout(-1)
+	if c.streamTimeout != 0 {
+		t.Errorf("Calling c.SetStreamTimeout(-1) should be ignored")
+	}
+	c.SetStreamTimeout(2 * time.Second)
+	s, e := c.ScanReaderWithSize(ctx, bytes.NewReader(content), int64(len(content)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Bytes != int64(len(content)) {
+		t.Errorf("The whole stream should be sent got %v", s)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		if _, err := tc.ReadLine(); err != nil {
+			return
+		}
+		// Read the content slowly
+		buf := make([]byte, 1024)
+		for {
+			time.Sleep(10 * time.Millisecond)
+			if _, err := tc.R.Read(buf); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	content := bytes.Repeat([]byte("a"), 64*1024*1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, e = c.ScanReaderWithSize(ctx, bytes.NewReader(content), int64(len(content)))
+	if e != context.Canceled {
+		t.Errorf("Got %v want %v", e, context.Canceled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("The copy should be interrupted promptly took %s", d)
+	}
+	if c.tc != nil {
+		t.Errorf("The connection should be discarded")
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestNewClientConn(t *testing.T) {
+	done := make(chan struct{})
+	cc, sc := net.Pipe()
+	go func() {
+		defer close(done)
+		tc := textproto.NewConn(sc)
+		defer tc.Close()
+		testScanHandler(tc)
+	}()
+	c := NewClientConn(cc)
+	if c.address != "pipe" {
+		t.Errorf("Got %q want %q", c.address, "pipe")
+	}
+	ctx := context.Background()
+	if _, e := c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	s, e := c.ScanReader(ctx, strings.NewReader(eicarVirus))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Errorf("The stream should be infected got %v", s)
+	}
+	if e = c.Close(ctx); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The supplied connection should be closed")
+	}
+	if _, e = c.Info(ctx); e == nil || e.Error() != connClosedErr {
+		t.Errorf("Got %v want %q", e, connClosedErr)
+	}
+}
+
+func testPipeClient(t *testing.T, server func(net.Conn)) (c *Client) {
+	cc, sc := net.Pipe()
+	go func() {
+		defer sc.Close()
+		server(sc)
+	}()
+	c = NewClientConn(cc)
+	return
+}
+
+func TestCloseContext(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = c.Close(context.Background()); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	c = testPipeClient(t, func(conn net.Conn) {
+		<-done
+	})
+	conn := c.conn
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if e = c.Close(ctx); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close should return once the context is done, took %s", d)
+	}
+	if _, e = conn.Write([]byte("QUIT\r\n")); e == nil {
+		t.Errorf("The connection should be closed")
+	}
+}
+
+func TestCloseReuse(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		s, e := c.ScanReader(ctx, strings.NewReader(eicarVirus))
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(s) != 1 || !s[0].Infected {
+			t.Errorf("The stream should be infected got %v", s)
+		}
+		if e = c.Close(ctx); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if c.tc != nil || c.conn != nil {
+			t.Errorf("The connection state should be reset by Close")
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	var quits int32
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch line {
+			case "HELP":
+				testWriteLine(tc, "%s", testBanner)
+				testWriteLine(tc, "")
+			case "QUIT":
+				atomic.AddInt32(&quits, 1)
+				return
+			}
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+	c.Reset()
+	ctx := context.Background()
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.Reset()
+	if c.tc != nil || c.conn != nil {
+		t.Errorf("The connection state should be reset")
+	}
+	if c.cmdTimeout != 5*time.Second {
+		t.Errorf("The settings should be kept")
+	}
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.Reset()
+	if n := atomic.LoadInt32(&quits); n != 0 {
+		t.Errorf("QUIT should not be sent got %d", n)
+	}
+}
+
+func TestReadResponsesPartial(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	c := testPipeClient(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "0 <clean> /tmp/file1\n")
+		<-done
+	})
+	defer c.tc.Close()
+	c.SetCmdTimeout(50 * time.Millisecond)
+	var s []*Response
+	e := c.readResponses(context.Background(), 2, collect(&s))
+	if ne, ok := e.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("A timeout error should be returned got %v", e)
+	}
+	if len(s) != 1 || s[0].Filename != "/tmp/file1" {
+		t.Errorf("The parsed responses should be returned got %v", s)
+	}
+	c = testPipeClient(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "1 <infected: EICAR_Test_File> /tmp/file1\n")
+		fmt.Fprintf(conn, "garbage\n")
+		fmt.Fprintf(conn, "0 <clean> /tmp/file3\n")
+	})
+	s = nil
+	e = c.readResponses(context.Background(), 3, collect(&s))
+	if e == nil || !strings.HasPrefix(e.Error(), "Invalid server response") {
+		t.Fatalf("An invalid response error should be returned got %v", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Errorf("The parsed responses should be returned got %v", s)
+	}
+	if c.tc != nil {
+		t.Errorf("The connection should be discarded after an invalid response")
+	}
+}
+
+func TestReadResponsesCRLF(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		io.WriteString(conn, "0 <clean> /tmp/file1\r\n")
+		io.WriteString(conn, "1 <infected: EICAR_Test_File> /tmp/file2.zip->eicar.com\r\n")
+		io.WriteString(conn, "1 <infected: EICAR_Test_File> /tmp/file2.zip\r\n")
+	})
+	defer c.tc.Close()
+	var s []*Response
+	e := c.readResponses(context.Background(), 2, collect(&s))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 3 {
+		t.Fatalf("Expected 3 got %d", len(s))
+	}
+	expected := []struct {
+		filename string
+		item     string
+	}{
+		{"/tmp/file1", ""},
+		{"/tmp/file2.zip", "eicar.com"},
+		{"/tmp/file2.zip", ""},
+	}
+	for i, rt := range s {
+		if rt.Filename != expected[i].filename || rt.ArchiveItem != expected[i].item {
+			t.Errorf("Got %q %q want %q %q", rt.Filename, rt.ArchiveItem, expected[i].filename, expected[i].item)
+		}
+		if strings.HasSuffix(rt.Raw, "\r") {
+			t.Errorf("The carriage return should be trimmed from %q", rt.Raw)
+		}
+	}
+}
+
+func TestResponsePattern(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		io.WriteString(conn, "file=/tmp/file1 code=1 status=infected sig=EICAR_Test_File\n")
+	})
+	defer c.tc.Close()
+	c.SetResponsePattern(regexp.MustCompile(`^file=(?P<name>\S+)`))
+	if c.responseRe != nil {
+		t.Errorf("A pattern without the required groups should be ignored")
+	}
+	c.SetResponsePattern(regexp.MustCompile(`^file=(?P<filename>\S+) code=(?P<statuscode>\d+) status=(?P<status>\S+)(?: sig=(?P<signature>\S+))?$`))
+	var s []*Response
+	e := c.readResponses(context.Background(), 1, collect(&s))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 {
+		t.Fatalf("Expected 1 got %d", len(s))
+	}
+	if s[0].Filename != "/tmp/file1" || !s[0].Infected || s[0].Signature != "EICAR_Test_File" || s[0].Status != "infected" {
+		t.Errorf("The response was not parsed got %+v", s[0])
+	}
+	c.SetResponsePattern(nil)
+	if c.responseRe != nil {
+		t.Errorf("nil should restore the built in pattern")
+	}
+}
+
+func TestReadResponsesCount(t *testing.T) {
+	tests := []struct {
+		lines    string
+		n        int
+		expected int
+	}{
+		{"0 <clean> /tmp/file1\n\n", 3, 1},
+		{"1 <infected: EICAR_Test_File> /tmp/file1->eicar.com\n1 <infected: EICAR_Test_File> /tmp/file1\n0 <clean> /tmp/file2\n", 2, 3},
+		{"0 <clean> /tmp/file1\n0 <clean> /tmp/file2\n", 2, 2},
+		{"\n", 1, 0},
+	}
+	for _, tt := range tests {
+		done := make(chan struct{})
+		c := testPipeClient(t, func(conn net.Conn) {
+			io.WriteString(conn, tt.lines)
+			<-done
+		})
+		c.SetCmdTimeout(time.Second)
+		var s []*Response
+		e := c.readResponses(context.Background(), tt.n, collect(&s))
+		if e != nil {
+			t.Errorf("An error should not be returned: %s", e)
+		}
+		if len(s) != tt.expected {
+			t.Errorf("%q: expected %d got %d", tt.lines, tt.expected, len(s))
+		}
+		if c.tc.R.Buffered() != 0 {
+			t.Errorf("%q: the response should be fully read", tt.lines)
+		}
+		close(done)
+		c.tc.Close()
+	}
+}
+
+func TestReadResponsesSplit(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		io.WriteString(conn, "0 <clean> /tmp/file1\n")
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(conn, "0 <clean> /tmp/file2\n")
+	})
+	defer c.Close(context.Background())
+	c.SetCmdTimeout(time.Second)
+	var s []*Response
+	e := c.readResponses(context.Background(), 2, collect(&s))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 2 {
+		t.Fatalf("Expected 2 got %d", len(s))
+	}
+}
+
+func TestReadResponsesEOF(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {})
+	defer c.Close(context.Background())
+	var s []*Response
+	e := c.readResponses(context.Background(), 2, collect(&s))
+	if e != io.EOF {
+		t.Fatalf("Got %v want %v", e, io.EOF)
+	}
+	if len(s) != 0 {
+		t.Fatalf("Expected 0 got %d", len(s))
+	}
+	for _, rt := range s {
+		if rt == nil {
+			t.Errorf("A nil response should not be returned")
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	small := path.Join(dir, "small.txt")
+	large := path.Join(dir, "large.txt")
+	if e = ioutil.WriteFile(small, []byte("small"), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	if e = ioutil.WriteFile(large, []byte(eicarVirus), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetMaxFileSize(-1)
+	if c.maxFileSize != 0 {
+		t.Errorf("Preventing negative values in c.SetMaxFileSize(%d) failed", -1)
+	}
+	c.SetMaxFileSize(10)
+	ctx := context.Background()
+	s, e := c.ScanStream(ctx, small)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Filename != small || s[0].StatusCode != NoMatch {
+		t.Errorf("The small file should be scanned")
+	}
+	s, e = c.ScanStream(ctx, large)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 {
+		t.Fatalf("Expected 1 got %d", len(s))
+	}
+	if s[0].Filename != large {
+		t.Errorf("Got %q want %q", s[0].Filename, large)
+	}
+	if s[0].StatusCode != SkipError {
+		t.Errorf("Got %d want %d", s[0].StatusCode, SkipError)
+	}
+	if s[0].Status != oversizeStatus {
+		t.Errorf("Got %q want %q", s[0].Status, oversizeStatus)
+	}
+	if s[0].Infected {
+		t.Errorf("Infected expected %t got %t", false, s[0].Infected)
+	}
+}
+
+// testFlakyHandler resets the first n connections after
+// reading a command and its content
+func testFlakyHandler(n int32, handler func(*textproto.Conn)) func(net.Conn) {
+	var conns int32
+	return func(conn net.Conn) {
+		tc := textproto.NewConn(conn)
+		defer tc.Close()
+		if atomic.AddInt32(&conns, 1) > n {
+			handler(tc)
+			return
+		}
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		var name string
+		var size int64
+		if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err == nil {
+			io.CopyN(ioutil.Discard, tc.R, size)
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+	}
+}
+
+func TestCommandRetry(t *testing.T) {
+	fn := path.Join("examples", "data", "eicar.txt")
+	address, stop := testConnServer(t, testFlakyHandler(1, testScanHandler))
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetConnSleep(10 * time.Millisecond)
+	ctx := context.Background()
+	if _, e = c.ScanFile(ctx, fn); e == nil {
+		t.Fatalf("An error should be returned without retries")
+	}
+	c.discard()
+	address, stop = testConnServer(t, testFlakyHandler(1, testScanHandler))
+	defer stop()
+	c, e = NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetConnSleep(10 * time.Millisecond)
+	c.SetConnRetries(1)
+	s, e := c.ScanFile(ctx, fn)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Errorf("The file should be scanned on the second attempt")
+	}
+	address, stop = testConnServer(t, testFlakyHandler(1, testScanHandler))
+	defer stop()
+	c, e = NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetConnSleep(10 * time.Millisecond)
+	c.SetConnRetries(1)
+	if _, e = c.ScanReader(ctx, strings.NewReader(eicarVirus)); e == nil {
+		t.Errorf("An error should be returned, streamed content should not be retried")
+	}
+}
+
+func TestHeuristicsInfected(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "SCAN FILE ") {
+				testWriteLine(tc, "2 <suspicious: Heur_Packed> %s", strings.TrimPrefix(line, "SCAN FILE "))
+			}
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	fn := path.Join("examples", "data", "eicar.txt")
+	for _, infected := range []bool{true, false} {
+		c.SetHeuristicsInfected(infected)
+		s, e := c.ScanFile(ctx, fn)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(s) != 1 {
+			t.Fatalf("Expected 1 got %d", len(s))
+		}
+		if s[0].Infected != infected {
+			t.Errorf("Infected expected %t got %t", infected, s[0].Infected)
+		}
+		if !s[0].StatusCode.Has(HeuristicMatch) {
+			t.Errorf("The HeuristicMatch status should be set")
+		}
+		if s[0].Signature != "Heur_Packed" {
+			t.Errorf("Got %q want %q", s[0].Signature, "Heur_Packed")
+		}
+	}
+	if st := c.Stats(); st.Infected != 1 {
+		t.Errorf("Expected 1 got %d", st.Infected)
+	}
+}
+
+func TestSignatureTransform(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		var name string
+		var size int64
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+			return
+		}
+		io.CopyN(ioutil.Discard, tc.R, size)
+		testWriteLine(tc, "1 <infected: EICAR_Test_File, W32/Heur_Packed> %s", name)
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetSignatureTransform(func(s string) string {
+		return strings.ToUpper(strings.TrimPrefix(s, "W32/"))
+	})
+	ctx := context.Background()
+	defer c.Close(ctx)
+	s, e := c.ScanReader(ctx, strings.NewReader(eicarVirus))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 {
+		t.Fatalf("Expected 1 got %d", len(s))
+	}
+	expected := []string{"EICAR_TEST_FILE", "HEUR_PACKED"}
+	if !reflect.DeepEqual(s[0].Signatures, expected) {
+		t.Errorf("Got %v want %v", s[0].Signatures, expected)
+	}
+	if s[0].Signature != expected[0] {
+		t.Errorf("Got %q want %q", s[0].Signature, expected[0])
+	}
+	if !strings.Contains(s[0].Raw, "W32/Heur_Packed") {
+		t.Errorf("The raw response should keep the signature got %q", s[0].Raw)
+	}
+}
+
+func TestOnReconnect(t *testing.T) {
+	fn := path.Join("examples", "data", "eicar.txt")
+	address, stop := testConnServer(t, testFlakyHandler(1, testScanHandler))
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetConnSleep(10 * time.Millisecond)
+	c.SetConnRetries(1)
+	var attempts []int
+	ctx := context.Background()
+	c.SetOnReconnect(func(attempt int, err error) {
+		if err == nil {
+			t.Errorf("The error that caused the reconnect should be passed")
+		}
+		attempts = append(attempts, attempt)
+		// The client must be usable from the callback
+		if _, e := c.ScanFile(ctx, fn); e != nil {
+			t.Errorf("An error should not be returned: %s", e)
+		}
+	})
+	if _, e = c.ScanFile(ctx, fn); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(attempts) != 1 || attempts[0] != 1 {
+		t.Errorf("Expected one reconnect got %v", attempts)
+	}
+}
+
+func TestStaleConnRetry(t *testing.T) {
+	var conns int32
+	// The server closes each connection once it has been idle
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		atomic.AddInt32(&conns, 1)
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		switch {
+		case line == "HELP":
+			testWriteLine(tc, "%s", testBanner)
+			testWriteLine(tc, "")
+		case strings.HasPrefix(line, "SCAN FILE "):
+			testWriteLine(tc, "1 <infected: EICAR_Test_File> %s", strings.TrimPrefix(line, "SCAN FILE "))
+		case strings.HasPrefix(line, "SCAN STREAM "):
+			var name string
+			var size int64
+			if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+				return
+			}
+			if _, err = io.CopyN(ioutil.Discard, tc.R, size); err != nil {
+				return
+			}
+			testWriteLine(tc, "1 <infected: EICAR_Test_File> %s", name)
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	var reconnects int
+	c.SetOnReconnect(func(attempt int, err error) {
+		reconnects++
+	})
+	ctx := context.Background()
+	defer c.Close(ctx)
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	time.Sleep(50 * time.Millisecond)
+	fn := path.Join("examples", "data", "eicar.txt")
+	s, e := c.ScanFile(ctx, fn)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Errorf("The file should be scanned over a new connection got %v", s)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if n := atomic.LoadInt32(&conns); n != 3 {
+		t.Errorf("Expected 3 connections got %d", n)
+	}
+	if reconnects != 2 {
+		t.Errorf("Expected 2 reconnects got %d", reconnects)
+	}
+	// A stream is not sent over a connection that was closed
+	time.Sleep(2 * aliveIdle)
+	if s, e = c.ScanReader(ctx, strings.NewReader(eicarVirus)); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || !s[0].Infected {
+		t.Errorf("The stream should be scanned over a new connection got %v", s)
+	}
+	if n := atomic.LoadInt32(&conns); n != 4 {
+		t.Errorf("Expected 4 connections got %d", n)
+	}
+	// A new connection that is closed is not retried
+	address, stop = testServer(t, func(tc *textproto.Conn) {})
+	defer stop()
+	if c, e = NewClient(address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.ScanFile(ctx, fn); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestQueueBatchSize(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 5; i++ {
+		fn := path.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if e = ioutil.WriteFile(fn, []byte(eicarVirus), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	l := &testLogger{}
+	c.SetLogger(l)
+	c.SetQueueBatchSize(2)
+	s, e := c.ScanDir(context.Background(), dir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 5 {
+		t.Errorf("Expected 5 got %d", len(s))
+	}
+	var queues int
+	for _, line := range l.lines {
+		if line == "> QUEUE" {
+			queues++
+		}
+	}
+	if queues != 2 {
+		t.Errorf("Expected 2 batches to be queued got %d", queues)
+	}
+}
+
+func TestPlanDir(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]int{"file1.txt": 10, "file2.txt": 100, "file3.exe": 10}
+	for fn, size := range files {
+		if e = ioutil.WriteFile(path.Join(dir, fn), make([]byte, size), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	c, e := NewClient("127.0.0.1:1")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetMaxFileSize(50)
+	c.SetExcludeExtensions([]string{"exe"})
+	fls, e := c.PlanDir(dir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(fls) != 1 || fls[0] != path.Join(dir, "file1.txt") {
+		t.Errorf("Got %q want %q", fls, []string{path.Join(dir, "file1.txt")})
+	}
+	if c.tc != nil {
+		t.Errorf("A connection should not be made")
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		var name string
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Sscanf(line, "SCAN FILE %s", &name); err != nil {
+				return
+			}
+			time.Sleep(40 * time.Millisecond)
+			testWriteLine(tc, "0 <clean> %s", name)
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetQueueBatchSize(1)
+	c.SetScanTimeout(100 * time.Millisecond)
+	s, e := c.ScanFiles(context.Background(), "/tmp/1", "/tmp/2", "/tmp/3", "/tmp/4", "/tmp/5", "/tmp/6")
+	if e != context.DeadlineExceeded {
+		t.Errorf("Got %v want %v", e, context.DeadlineExceeded)
+	}
+	if len(s) == 0 || len(s) >= 6 {
+		t.Errorf("Partial results should be returned got %d", len(s))
+	}
+	c.SetScanTimeout(0)
+	if s, e = c.ScanFiles(context.Background(), "/tmp/1", "/tmp/2"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 2 {
+		t.Errorf("Expected 2 got %d", len(s))
+	}
+}
+
+func TestScanDirInfected(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	infected := path.Join(dir, "eicar.com")
+	if e = ioutil.WriteFile(infected, []byte(eicarVirus), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	for i := 0; i < 3; i++ {
+		if e = ioutil.WriteFile(path.Join(dir, fmt.Sprintf("file%d.txt", i)), []byte("clean"), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	sm, s, e := c.ScanDirInfected(context.Background(), dir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Filename != infected {
+		t.Errorf("Only the infected file should be returned got %v", s)
+	}
+	expected := Summary{Scanned: 4, Clean: 3, Infected: 1}
+	if sm != expected {
+		t.Errorf("Got %+v want %+v", sm, expected)
+	}
+}
+
+func TestScanDirSummary(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	if e = ioutil.WriteFile(path.Join(dir, "eicar.com"), []byte(eicarVirus), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	for i := 0; i < 2; i++ {
+		if e = ioutil.WriteFile(path.Join(dir, fmt.Sprintf("file%d.txt", i)), []byte("clean"), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	sm, s, e := c.ScanDirSummary(context.Background(), dir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 3 {
+		t.Errorf("Expected 3 got %d", len(s))
+	}
+	expected := Summary{Scanned: 3, Clean: 2, Infected: 1}
+	if sm != expected {
+		t.Errorf("Got %+v want %+v", sm, expected)
+	}
+	sm = Summary{}
+	for _, code := range []StatusCode{NoMatch, Infected | SkipError, SystemError, SkipError} {
+		sm.add(&Response{StatusCode: code, Infected: code&infectedStatusCodes != 0})
+	}
+	expected = Summary{Scanned: 4, Clean: 1, Infected: 1, Errors: 1, Skipped: 2}
+	if sm != expected {
+		t.Errorf("Got %+v want %+v", sm, expected)
+	}
+}
+
+func TestScanPaths(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	sub := path.Join(dir, "sub")
+	if e = os.Mkdir(sub, 0755); e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	fn := path.Join(dir, "file1.txt")
+	for _, p := range []string{fn, path.Join(sub, "file2.txt"), path.Join(sub, "file3.txt")} {
+		if e = ioutil.WriteFile(p, []byte(eicarVirus), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	missing := path.Join(dir, "missing")
+	s, e := c.ScanPaths(ctx, fn, sub, missing)
+	if len(s) != 3 {
+		t.Errorf("Expected 3 got %d", len(s))
+	}
+	we, ok := e.(*WalkError)
+	if !ok {
+		t.Fatalf("A WalkError should be returned got %T", e)
+	}
+	if len(we.Errors) != 1 || !os.IsNotExist(we.Errors[0]) {
+		t.Errorf("The missing path should be reported got %v", we.Errors)
+	}
+	if _, e = c.ScanPaths(ctx); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestWalkErrorScanError(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "encrypted.zip")
+	if e = ioutil.WriteFile(fn, []byte("encrypted"), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	if e = os.Symlink(path.Join(dir, "missing"), path.Join(dir, "broken")); e != nil {
+		t.Fatalf("Symlink creation failed")
+	}
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "SCAN FILE ") {
+				testWriteLine(tc, "64 <skipped> %s", strings.TrimPrefix(line, "SCAN FILE "))
+			}
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetFollowSymlinks(true)
+	ctx := context.Background()
+	defer c.Close(ctx)
+	for name, scan := range map[string]func() ([]*Response, error){
+		"ScanDir": func() ([]*Response, error) {
+			return c.ScanDir(ctx, dir)
+		},
+		"ScanDirParallel": func() ([]*Response, error) {
+			return c.ScanDirParallel(ctx, dir, 2)
+		},
+		"ScanPaths": func() ([]*Response, error) {
+			return c.ScanPaths(ctx, fn, path.Join(dir, "missing"))
+		},
+	} {
+		s, e := scan()
+		if len(s) != 1 {
+			t.Errorf("%s: expected 1 got %d", name, len(s))
+		}
+		we, ok := e.(*WalkError)
+		if !ok {
+			t.Errorf("%s: a WalkError should be returned got %T", name, e)
+			continue
+		}
+		if len(we.Errors) != 1 {
+			t.Errorf("%s: expected 1 walk error got %d", name, len(we.Errors))
+		}
+		if we.Err == nil || we.Err.Code != SkipError {
+			t.Errorf("%s: the ScanError should be kept got %v", name, we.Err)
+		}
+		if we.Unwrap() != error(we.Err) {
+			t.Errorf("%s: Unwrap should return the ScanError", name)
+		}
+	}
+}
+
+func TestScanDirStreamFunc(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 5; i++ {
+		fn := path.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if e = ioutil.WriteFile(fn, []byte(eicarVirus), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	var seen []string
+	e = c.ScanDirStreamFunc(ctx, dir, func(rt *Response) error {
+		if !rt.Infected {
+			t.Errorf("%s Infected expected %t got %t", rt.Filename, true, rt.Infected)
+		}
+		seen = append(seen, rt.Filename)
+		return nil
+	})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected %d got %d", 5, len(seen))
+	}
+	abort := errors.New("abort")
+	seen = nil
+	e = c.ScanDirStreamFunc(ctx, dir, func(rt *Response) error {
+		seen = append(seen, rt.Filename)
+		return abort
+	})
+	if e != abort {
+		t.Errorf("Got %v want %v", e, abort)
+	}
+	if len(seen) != 1 {
+		t.Errorf("Expected %d got %d", 1, len(seen))
+	}
+	if c.tc != nil {
+		t.Errorf("The connection should be discarded after an abort")
+	}
+	s, e := c.ScanDirStream(ctx, dir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 5 {
+		t.Errorf("Expected %d got %d", 5, len(s))
+	}
+}
+
+func TestScanDirStreamChan(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 5; i++ {
+		fn := path.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if e = ioutil.WriteFile(fn, []byte(eicarVirus), 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	rc, ec := c.ScanDirStreamChan(ctx, dir)
+	n := 0
+	for rt := range rc {
+		if !rt.Infected {
+			t.Errorf("%s Infected expected %t got %t", rt.Filename, true, rt.Infected)
+		}
+		n++
+	}
+	if e = <-ec; e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if n != 5 {
+		t.Errorf("Expected %d got %d", 5, n)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	rc, ec = c.ScanDirStreamChan(cctx, dir)
+	<-rc
+	cancel()
+	for range rc {
+	}
+	if e = <-ec; e != context.Canceled {
+		t.Errorf("Got %v want %v", e, context.Canceled)
+	}
+	rc, ec = c.ScanDirStreamChan(ctx, "/tmxts/hylsgxut.2s.sas")
+	for range rc {
+	}
+	if e = <-ec; e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				if _, err := c.Info(ctx); err != nil {
+					t.Errorf("An error should not be returned: %s", err)
+				}
+				return
+			}
+			s, err := c.ScanReader(ctx, strings.NewReader(eicarVirus))
+			if err != nil {
+				t.Errorf("An error should not be returned: %s", err)
+				return
+			}
+			if len(s) != 1 || !s[0].Infected {
+				t.Errorf("The stream should be infected got %v", s)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestScanDirParallel(t *testing.T) {
+	var conns int32
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	expected := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		fn := path.Join(dir, fmt.Sprintf("file%d.txt", i))
+		content := []byte("temporary file's content")
+		infected := i%4 == 0
+		if infected {
+			content = []byte(eicarVirus)
+		}
+		if e = ioutil.WriteFile(fn, content, 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+		expected[fn] = infected
+	}
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		atomic.AddInt32(&conns, 1)
+		testScanHandler(tc)
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	s, e := c.ScanDirParallel(context.Background(), dir, 4)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != len(expected) {
+		t.Fatalf("Expected %d got %d", len(expected), len(s))
+	}
+	for _, rt := range s {
+		infected, ok := expected[rt.Filename]
+		if !ok {
+			t.Errorf("Unexpected filename %s", rt.Filename)
+			continue
+		}
+		if rt.Infected != infected {
+			t.Errorf("%s Infected expected %t got %t", rt.Filename, infected, rt.Infected)
+		}
+		delete(expected, rt.Filename)
+	}
+	if n := atomic.LoadInt32(&conns); n < 1 || n > 4 {
+		t.Errorf("Expected at most %d connections got %d", 4, n)
+	}
+	if c.tc != nil {
+		t.Errorf("The parallel scan should not use the client connection")
+	}
+}
+
+func TestClone(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	l := &testLogger{}
+	c.SetConnTimeout(2 * time.Second)
+	c.SetCmdTimeout(3 * time.Second)
+	c.SetConnRetries(2)
+	c.SetLogger(l)
+	ctx := context.Background()
+	defer c.Close(ctx)
+	if _, e = c.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	n := c.Clone()
+	defer n.Close(ctx)
+	if n.tc != nil || n.conn != nil {
+		t.Errorf("The clone should not be connected")
+	}
+	if n.address != c.address || n.connTimeout != 2*time.Second ||
+		n.cmdTimeout != 3*time.Second || n.connRetries != 2 || n.logger != l {
+		t.Errorf("The settings should be copied")
+	}
+	if n.Stats().Scans != 0 {
+		t.Errorf("The clone should have its own stats")
+	}
+	if _, e = n.ScanFile(ctx, path.Join("examples", "data", "eicar.txt")); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if n.tc == c.tc {
+		t.Errorf("The clone should have its own connection")
+	}
+	n.SetCmdTimeout(time.Second)
+	if c.cmdTimeout != 3*time.Second {
+		t.Errorf("Changing the clone should not change the client")
+	}
+}
+
+func TestScanReaders(t *testing.T) {
+	var conns int32
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		atomic.AddInt32(&conns, 1)
+		testScanHandler(tc)
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	if _, e = c.ScanReaders(ctx, nil, 2); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if _, e = c.ScanReaders(ctx, map[string]io.Reader{"bad\nname": strings.NewReader("")}, 2); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	readers := map[string]io.Reader{}
+	expected := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("attachment%d", i)
+		content := "temporary file's content"
+		infected := i%3 == 0
+		if infected {
+			content = eicarVirus
+		}
+		readers[name] = strings.NewReader(content)
+		expected[name] = infected
+	}
+	m, e := c.ScanReaders(ctx, readers, 3)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(m) != len(expected) {
+		t.Fatalf("Expected %d got %d", len(expected), len(m))
+	}
+	for name, infected := range expected {
+		if len(m[name]) != 1 {
+			t.Errorf("%s: expected 1 response got %d", name, len(m[name]))
+			continue
+		}
+		if m[name][0].Filename != name {
+			t.Errorf("Got %s want %s", m[name][0].Filename, name)
+		}
+		if m[name][0].Infected != infected {
+			t.Errorf("%s Infected expected %t got %t", name, infected, m[name][0].Infected)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n < 1 || n > 3 {
+		t.Errorf("Expected at most %d connections got %d", 3, n)
+	}
+}
+
+func TestResponseDuration(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(conn, "0 <clean> /tmp/file1\n")
+		time.Sleep(40 * time.Millisecond)
+		io.WriteString(conn, "0 <clean> /tmp/file2\n")
+	})
+	defer c.tc.Close()
+	var s []*Response
+	e := c.readResponses(context.Background(), 2, collect(&s))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 2 {
+		t.Fatalf("Expected 2 got %d", len(s))
+	}
+	if s[0].Duration < 20*time.Millisecond {
+		t.Errorf("Got %s want >= %s", s[0].Duration, 20*time.Millisecond)
+	}
+	if s[1].Duration < 40*time.Millisecond {
+		t.Errorf("Got %s want >= %s", s[1].Duration, 40*time.Millisecond)
+	}
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, ok := c.logger.(nopLogger); !ok {
+		t.Errorf("The default logger should be a no-op logger")
+	}
+	l := &testLogger{}
+	c.SetLogger(l)
+	if _, e = c.ScanReader(context.Background(), strings.NewReader(eicarVirus)); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	expected := []string{
+		fmt.Sprintf("> SCAN STREAM stream SIZE %d", len(eicarVirus)),
+		"< 1 <infected: EICAR_Test_File> stream",
+	}
+	if strings.Join(l.lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got %q want %q", l.lines, expected)
+	}
+	c.SetLogger(nil)
+	if _, ok := c.logger.(nopLogger); !ok {
+		t.Errorf("Setting a nil logger should restore the no-op logger")
+	}
+}
+
+func TestResultHook(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		io.WriteString(conn, "0 <clean> /tmp/file1\n")
+		io.WriteString(conn, "64 <skipped> /tmp/file2\n")
+	})
+	defer c.tc.Close()
+	var seen []*Response
+	c.SetResultHook(func(rt *Response) {
+		seen = append(seen, rt)
+	})
+	var s []*Response
+	e := c.readResponses(context.Background(), 2, collect(&s))
+	if e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if len(seen) != 2 {
+		t.Fatalf("Expected 2 got %d", len(seen))
+	}
+	for i := range s {
+		if seen[i] != s[i] {
+			t.Errorf("The hook should be called with each response")
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if s := c.Stats(); s != (Stats{}) {
+		t.Errorf("The counters should start at zero got %+v", s)
+	}
+	ctx := context.Background()
+	if _, e = c.ScanReader(ctx, strings.NewReader(eicarVirus)); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.ScanReader(ctx, strings.NewReader("clean")); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.ScanFile(ctx, "/tmxts/hylsgxut.2s.sas"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	expected := Stats{
+		Scans:    3,
+		Infected: 1,
+		Errors:   1,
+		Bytes:    uint64(len(eicarVirus) + len("clean")),
+	}
+	if s := c.Stats(); s != expected {
+		t.Errorf("Got %+v want %+v", s, expected)
+	}
+}
+
+func TestResponseSignatures(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		io.WriteString(conn, "1 <infected: EICAR_Test_File> /tmp/file1\n")
+		io.WriteString(conn, "1 <infected: EICAR_Test_File, W32/Virut.A,W32/Sality.AA> /tmp/file2\n")
+		io.WriteString(conn, "0 <clean> /tmp/file3\n")
+	})
+	defer c.tc.Close()
+	var s []*Response
+	e := c.readResponses(context.Background(), 3, collect(&s))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 3 {
+		t.Fatalf("Expected 3 got %d", len(s))
+	}
+	expected := [][]string{
+		{"EICAR_Test_File"},
+		{"EICAR_Test_File", "W32/Virut.A", "W32/Sality.AA"},
+		nil,
+	}
+	for i, rt := range s {
+		if !reflect.DeepEqual(rt.Signatures, expected[i]) {
+			t.Errorf("Got %q want %q", rt.Signatures, expected[i])
+		}
+		if len(expected[i]) > 0 && rt.Signature != expected[i][0] {
+			t.Errorf("Got %q want %q", rt.Signature, expected[i][0])
+		}
+	}
+	if s[2].Signature != "" {
+		t.Errorf("Got %q want %q", s[2].Signature, "")
+	}
+}
+
+func TestScanReaderArchiveMembers(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		var name string
+		var size int64
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+				return
+			}
+			if _, err = io.CopyN(ioutil.Discard, tc.R, size); err != nil {
+				return
+			}
+			testWriteLine(tc, "1 <infected: EICAR_Test_File> %s->a/eicar.com", name)
+			testWriteLine(tc, "1 <infected: EICAR_Test_File> %s->b/eicar.com", name)
+			testWriteLine(tc, "1 <infected: EICAR_Test_File> %s", name)
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	for i := 0; i < 2; i++ {
+		s, e := c.ScanReader(ctx, strings.NewReader(eicarVirus))
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(s) != 3 {
+			t.Fatalf("Expected 3 got %d", len(s))
+		}
+		items := []string{"a/eicar.com", "b/eicar.com", ""}
+		for j, rt := range s {
+			if !rt.Infected || rt.ArchiveItem != items[j] {
+				t.Errorf("Got %q want %q", rt.Raw, items[j])
+			}
+		}
+	}
+}
+
+func TestScanReaderArchiveMembersSplit(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		var name string
+		var size int64
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(line, "SCAN STREAM %s SIZE %d", &name, &size); err != nil {
+			return
+		}
+		if _, err = io.CopyN(ioutil.Discard, tc.R, size); err != nil {
+			return
+		}
+		testWriteLine(tc, "1 <infected: EICAR_Test_File> %s->a/eicar.com", name)
+		time.Sleep(20 * time.Millisecond)
+		testWriteLine(tc, "1 <infected: EICAR_Test_File> %s->b/eicar.com", name)
+		time.Sleep(20 * time.Millisecond)
+		testWriteLine(tc, "1 <infected: EICAR_Test_File> %s", name)
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	s, e := c.ScanReader(ctx, strings.NewReader(eicarVirus))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 3 {
+		t.Fatalf("Expected 3 got %d", len(s))
+	}
+	if s[2].ArchiveItem != "" {
+		t.Errorf("The last response should be for the stream: %q", s[2].Raw)
+	}
+}
+
+func TestResponseArchivePath(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		io.WriteString(conn, "0 <clean> /tmp/file1\n")
+		io.WriteString(conn, "1 <infected: EICAR_Test_File> /tmp/outer.zip->evil.exe\n")
+		io.WriteString(conn, "1 <infected: EICAR_Test_File> /tmp/outer.zip->inner.zip->evil.exe\n")
+		io.WriteString(conn, "1 <infected: EICAR_Test_File> /tmp/outer.zip->inner.tar->deep.zip->evil.exe\n")
+	})
+	defer c.tc.Close()
+	var s []*Response
+	e := c.readResponses(context.Background(), 4, collect(&s))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 4 {
+		t.Fatalf("Expected 4 got %d", len(s))
+	}
+	filenames := []string{"/tmp/file1", "/tmp/outer.zip", "/tmp/outer.zip", "/tmp/outer.zip"}
+	expected := [][]string{
+		nil,
+		{"evil.exe"},
+		{"inner.zip", "evil.exe"},
+		{"inner.tar", "deep.zip", "evil.exe"},
+	}
+	for i, rt := range s {
+		if rt.Filename != filenames[i] {
+			t.Errorf("Got %q want %q", rt.Filename, filenames[i])
+		}
+		if !reflect.DeepEqual(rt.ArchivePath, expected[i]) {
+			t.Errorf("Got %q want %q", rt.ArchivePath, expected[i])
+		}
+		leaf := ""
+		if len(expected[i]) > 0 {
+			leaf = expected[i][len(expected[i])-1]
+		}
+		if rt.ArchiveItem != leaf {
+			t.Errorf("Got %q want %q", rt.ArchiveItem, leaf)
+		}
+	}
+}
+
+func TestResponseHelpers(t *testing.T) {
+	tests := []struct {
+		code     StatusCode
+		clean    bool
+		hasError bool
+	}{
+		{NoMatch, true, false},
+		{Infected, false, false},
+		{HeuristicMatch, false, false},
+		{UserError, false, true},
+		{RestrictionError, false, true},
+		{SystemError, false, true},
+		{InternalError, false, true},
+		{SkipError, false, true},
+		{DisinfectError, false, true},
+		{Infected | HeuristicMatch, false, false},
+		{Infected | SkipError, false, true},
+	}
+	for _, tt := range tests {
+		rs := &Response{StatusCode: tt.code}
+		if rs.IsClean() != tt.clean {
+			t.Errorf("%d IsClean() = %t, want %t", tt.code, rs.IsClean(), tt.clean)
+		}
+		if rs.HasError() != tt.hasError {
+			t.Errorf("%d HasError() = %t, want %t", tt.code, rs.HasError(), tt.hasError)
+		}
+	}
+}
+
+func TestResponseJSON(t *testing.T) {
+	rs := Response{
+		Filename:    "/tmp/eicar.zip",
+		ArchiveItem: "eicar.txt",
+		Signature:   "EICAR_Test_File",
+		Signatures:  []string{"EICAR_Test_File"},
+		Status:      "infected",
+		StatusCode:  Infected,
+		Infected:    true,
+		ArchivePath: []string{"eicar.txt"},
+		Raw:         "1 <infected: EICAR_Test_File> /tmp/eicar.zip->eicar.txt",
+		Duration:    2 * time.Second,
+	}
+	b, e := json.Marshal(&rs)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	m := map[string]interface{}{}
+	if e = json.Unmarshal(b, &m); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	for k, v := range map[string]interface{}{
+		"filename":           "/tmp/eicar.zip",
+		"archive_item":       "eicar.txt",
+		"signature":          "EICAR_Test_File",
+		"status":             "infected",
+		"status_code":        float64(1),
+		"status_description": Infected.String(),
+		"infected":           true,
+	} {
+		if m[k] != v {
+			t.Errorf("%s: got %v want %v", k, m[k], v)
+		}
+	}
+	var out Response
+	if e = json.Unmarshal(b, &out); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !reflect.DeepEqual(out, rs) {
+		t.Errorf("Got %+v want %+v", out, rs)
+	}
+}
+
+func TestOrderResponses(t *testing.T) {
+	r := []*Response{
+		{Filename: "/tmp/c", Raw: "c"},
+		{Filename: "/tmp/a", Raw: "a"},
+		{Filename: "/tmp/other", Raw: "other"},
+		{Filename: "/tmp/c", ArchiveItem: "item", Raw: "c->item"},
+	}
+	o := orderResponses([]string{"/tmp/a", "/tmp/b", "/tmp/c"}, r)
+	expected := []string{"a", "", "c", "c->item", "other"}
+	if len(o) != len(expected) {
+		t.Fatalf("Expected %d got %d", len(expected), len(o))
+	}
+	for i, rs := range o {
+		if rs.Raw != expected[i] {
+			t.Errorf("Got %q want %q", rs.Raw, expected[i])
+		}
+	}
+	if o[1].Filename != "/tmp/b" || o[1].StatusCode != SkipError || o[1].Status != missingStatus {
+		t.Errorf("A placeholder should be returned for /tmp/b got %v", o[1])
+	}
+}
+
+func TestScanError(t *testing.T) {
+	c := testPipeClient(t, func(conn net.Conn) {
+		io.WriteString(conn, "0 <clean> /tmp/file1\n")
+		io.WriteString(conn, "64 <skipped> /tmp/file2\n")
+		io.WriteString(conn, "16 <platform error> /tmp/file3\n")
+	})
+	defer c.tc.Close()
+	var s []*Response
+	e := c.readResponses(context.Background(), 3, collect(&s))
+	if len(s) != 3 {
+		t.Fatalf("Expected 3 got %d", len(s))
+	}
+	se, ok := e.(*ScanError)
+	if !ok {
+		t.Fatalf("A ScanError should be returned got %T", e)
+	}
+	if se.Code != SkipError {
+		t.Errorf("Got %d want %d", se.Code, SkipError)
+	}
+	if se.Status != "skipped" {
+		t.Errorf("Got %q want %q", se.Status, "skipped")
+	}
+	if se.Filename != "/tmp/file2" {
+		t.Errorf("Got %q want %q", se.Filename, "/tmp/file2")
+	}
+	if e.Error() != "ERROR: skipped" {
+		t.Errorf("Got %q want %q", e, "ERROR: skipped")
+	}
+}
+
+func TestSupportsProtocol(t *testing.T) {
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned")
+	}
+	if c.SupportsProtocol("1") {
+		t.Errorf("An unknown protocol version should not be supported")
+	}
+	tests := []struct {
+		protocol string
+		min      string
+		out      bool
+	}{
+		{"4", "4", true},
+		{"4", "3", true},
+		{"4", "5", false},
+		{"4.6.5", "4.6", true},
+		{"4.6", "4.6.1", false},
+		{"4.6.0", "4.6", true},
+		{"4.10", "4.9", true},
+		{"4.6", "x", false},
+		{"unknown", "1", false},
+	}
+	for _, tt := range tests {
+		c.protocol = tt.protocol
+		if s := c.SupportsProtocol(tt.min); s != tt.out {
+			t.Errorf("%q.SupportsProtocol(%q) = %t, want %t", tt.protocol, tt.min, s, tt.out)
+		}
+	}
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	if c, e = NewClient(address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	i, e := c.Info(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if i.Protocol != "4.6" {
+		t.Errorf("Got %q want %q", i.Protocol, "4.6")
+	}
+	if i.Raw != testBanner {
+		t.Errorf("Got %q want %q", i.Raw, testBanner)
+	}
+	if !c.SupportsProtocol("4.6") {
+		t.Errorf("The protocol reported by the server should be stored")
+	}
+}
+
+func TestInfoRaw(t *testing.T) {
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		for {
+			line, err := tc.ReadLine()
+			if err != nil || line != "HELP" {
+				return
+			}
+			testWriteLine(tc, "FPSCAND:6.2.3 ENGINE:4.6.5")
+			testWriteLine(tc, "SIGNATURE:20210101")
+			testWriteLine(tc, "")
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	i, e := c.Info(context.Background())
+	if e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	raw := "FPSCAND:6.2.3 ENGINE:4.6.5\nSIGNATURE:20210101"
+	if i.Raw != raw {
+		t.Errorf("Got %q want %q", i.Raw, raw)
+	}
+	be, ok := e.(*BannerError)
+	if !ok {
+		t.Fatalf("A BannerError should be returned got %T", e)
+	}
+	if be.Raw != i.Raw {
+		t.Errorf("Got %q want %q", be.Raw, i.Raw)
+	}
+}
+
+func TestInfoMultiLineBanner(t *testing.T) {
+	banner := []string{
+		"FPSCAND:6.2.3 ENGINE:4.6.5",
+		"PROTOCOL:4.6 SIGNATURE:20210101",
+		"UPTIME:3600",
+	}
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch line {
+			case "HELP":
+				for _, l := range banner {
+					testWriteLine(tc, "%s", l)
+				}
+				testWriteLine(tc, "")
+			case "SCAN FILE /tmp/file":
+				testWriteLine(tc, "0 <clean> /tmp/file")
+			default:
+				return
+			}
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	i, e := c.Info(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if i.Protocol != "4.6" || i.Uptime != "3600" {
+		t.Errorf("The banner was not parsed got %+v", i)
+	}
+	if i.Raw != strings.Join(banner, "\n") {
+		t.Errorf("Got %q want %q", i.Raw, strings.Join(banner, "\n"))
+	}
+	s, e := c.ScanFile(ctx, "/tmp/file")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(s) != 1 || s[0].Filename != "/tmp/file" || s[0].StatusCode != 0 {
+		t.Errorf("The connection should not be desynchronized got %v", s)
+	}
+}
+
+func TestRawCommand(t *testing.T) {
+	var resent int32
+	address, stop := testConnServer(t, func(conn net.Conn) {
+		tc := textproto.NewConn(conn)
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch line {
+			case "HELP":
+				fmt.Fprintf(conn, "%s\n", testBanner)
+				time.Sleep(20 * time.Millisecond)
+				fmt.Fprintf(conn, "extra\n\n")
+			case "SCAN --adware FILE /tmp/file":
+				fmt.Fprintf(conn, "0 <clean> /tmp/file\n\n")
+			case "FAIL":
+				atomic.AddInt32(&resent, 1)
+				conn.Close()
+				return
+			default:
+				return
+			}
+		}
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	r, e := c.RawCommand(ctx, "HELP")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 2 || r[0] != testBanner || r[1] != "extra" {
+		t.Errorf("Got %q want %q", r, []string{testBanner, "extra"})
+	}
+	if r, e = c.RawCommand(ctx, "SCAN --adware FILE /tmp/file"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0] != "0 <clean> /tmp/file" {
+		t.Errorf("Got %q want %q", r, []string{"0 <clean> /tmp/file"})
+	}
+	for _, line := range []string{"", "HELP\r\nQUIT"} {
+		if _, e = c.RawCommand(ctx, line); e == nil {
+			t.Errorf("An error should be returned for %q", line)
+		}
+	}
+	if _, e = c.RawCommand(ctx, "FAIL"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if n := atomic.LoadInt32(&resent); n != 1 {
+		t.Errorf("The command should be sent once, sent %d times", n)
+	}
+}
+
+func TestGetFiles(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	if e = os.Chmod(dir, 0755); e != nil {
+		t.Errorf("Temp directory chmod failed")
+	}
+	// cm := map[string]bool{}
+	pts := []string{path.Join(dir, "file1.txt"), path.Join(dir, "file2.txt")}
+	content := []byte("temporary file's content")
+	for _, fn := range pts {
+		e = ioutil.WriteFile(fn, content, 0640)
+		if e != nil {
+			t.Errorf("Temp directory chmod failed")
+			continue
+		}
+		// cm[fn] = true
+		defer os.Remove(fn)
+	}
+	fls, e := getFiles(dir, listOptions{})
+	found := len(fls)
+	if found != 2 {
+		t.Errorf("Calling getFiles(%q) should return %q got %q", dir, 2, found)
+	}
+	if fls[0] != pts[0] && fls[1] != pts[1] {
+		t.Errorf("Files returned do not match created")
+	}
+	_, e = getFiles("/tmxts/hylsgxut.2s.sas", listOptions{})
+	if e == nil {
+		t.Errorf("An error should be returned")
+	}
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		gopath = build.Default.GOPATH
+	}
+	fn := path.Join(gopath, "src/github.com/baruwa-enterprise/fprot/README.md")
+	_, e = getFiles(fn, listOptions{})
+	if e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestGetFilesWalkError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("skipping test; permissions are not enforced for root")
+	}
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "file1.txt")
+	if e = ioutil.WriteFile(fn, []byte("temporary file's content"), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	sub := path.Join(dir, "unreadable")
+	if e = os.Mkdir(sub, 0000); e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.Chmod(sub, 0755)
+	fls, e := getFiles(dir, listOptions{})
+	if len(fls) != 1 || fls[0] != fn {
+		t.Errorf("The readable files should be returned got %v", fls)
+	}
+	we, ok := e.(*WalkError)
+	if !ok {
+		t.Fatalf("A WalkError should be returned got %T", e)
+	}
+	if len(we.Errors) != 1 {
+		t.Errorf("Expected 1 got %d", len(we.Errors))
+	}
+}
+
+func TestSkipUnreadable(t *testing.T) {
+	denied := &os.PathError{Op: "open", Path: "/data/secret", Err: os.ErrPermission}
+	l := &fileLister{listOptions: listOptions{skipUnreadable: true}}
+	l.visit("/data/secret", nil, denied)
+	l.visit("/data/broken", nil, os.ErrNotExist)
+	if len(l.unreadable) != 1 || l.unreadable[0] != "/data/secret" {
+		t.Errorf("Got %q want %q", l.unreadable, []string{"/data/secret"})
+	}
+	if len(l.errs) != 1 {
+		t.Errorf("Expected 1 got %d", len(l.errs))
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("skipping test; permissions are not enforced for root")
+	}
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "file1.txt")
+	if e = ioutil.WriteFile(fn, []byte("temporary file's content"), 0640); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	locked := path.Join(dir, "file2.txt")
+	if e = ioutil.WriteFile(locked, []byte("temporary file's content"), 0000); e != nil {
+		t.Fatalf("Temp file creation failed")
+	}
+	sub := path.Join(dir, "unreadable")
+	if e = os.Mkdir(sub, 0000); e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.Chmod(sub, 0755)
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetSkipUnreadable(true)
+	rs, e := c.ScanDir(context.Background(), dir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	skipped := map[string]bool{}
+	for _, r := range rs {
+		if r.StatusCode == SkipError && r.Status == unreadableStatus {
+			skipped[r.Filename] = true
+		}
+	}
+	if len(rs) != 3 || !skipped[locked] || !skipped[sub] {
+		t.Errorf("The unreadable paths should be skipped got %v", rs)
+	}
+}
+
+func TestGetFilesMaxDepth(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	if e = os.MkdirAll(path.Join(dir, "a", "b"), 0755); e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	content := []byte("temporary file's content")
+	for _, fn := range []string{"file0", "a/file1", "a/b/file2"} {
+		if e = ioutil.WriteFile(path.Join(dir, fn), content, 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	tests := []struct {
+		depth    int
+		expected []string
+	}{
+		{0, []string{"file0"}},
+		{1, []string{"file0", "file1"}},
+		{-1, []string{"file0", "file1", "file2"}},
+	}
+	for _, tt := range tests {
+		c.SetMaxDepth(tt.depth)
+		fls, e := getFiles(dir, c.listOpts)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		n := make([]string, len(fls))
+		for i, fn := range fls {
+			n[i] = filepath.Base(fn)
+		}
+		sort.Strings(n)
+		if strings.Join(n, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("depth: %d got %v want %v", tt.depth, n, tt.expected)
+		}
+	}
+}
+
+func TestGetFilesExcludeGlobs(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"a/cache", "cache", "b"} {
+		if e = os.MkdirAll(path.Join(dir, d), 0755); e != nil {
+			t.Fatalf("Temp directory creation failed")
+		}
+	}
+	content := []byte("temporary file's content")
+	for _, fn := range []string{"file1", "file2.tmp", "a/file3", "a/cache/file4", "cache/file5", "b/file6.tmp"} {
+		if e = ioutil.WriteFile(path.Join(dir, fn), content, 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	tests := []struct {
+		globs    []string
+		expected []string
+	}{
+		{nil, []string{"file1", "file2.tmp", "file3", "file4", "file5", "file6.tmp"}},
+		{[]string{"*.tmp"}, []string{"file1", "file3", "file4", "file5"}},
+		{[]string{"*/cache/*"}, []string{"file1", "file2.tmp", "file3", "file5", "file6.tmp"}},
+		{[]string{"cache", "b"}, []string{"file1", "file2.tmp", "file3"}},
+		{[]string{"[", "a/file3"}, []string{"file1", "file2.tmp", "file4", "file5", "file6.tmp"}},
+	}
+	for _, tt := range tests {
+		c.SetExcludeGlobs(tt.globs)
+		fls, e := getFiles(dir, c.listOpts)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		n := make([]string, len(fls))
+		for i, fn := range fls {
+			n[i] = filepath.Base(fn)
+		}
+		sort.Strings(n)
+		if strings.Join(n, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("globs: %v got %v want %v", tt.globs, n, tt.expected)
+		}
+	}
+}
+
+func TestFileList(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	if e = os.Mkdir(path.Join(dir, "sub"), 0755); e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	content := []byte("temporary file's content")
+	for _, fn := range []string{"file1.txt", "file2.tmp", "file3.exe", "sub/file4.txt"} {
+		if e = ioutil.WriteFile(path.Join(dir, fn), content, 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	fls, e := FileList(dir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(fls) != 4 {
+		t.Errorf("Expected 4 got %d", len(fls))
+	}
+	fls, e = FileList(dir,
+		ListMaxDepth(0),
+		ListExcludeExtensions([]string{"exe"}),
+		ListExcludeGlobs([]string{"*.tmp"}),
+	)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(fls) != 1 || fls[0] != path.Join(dir, "file1.txt") {
+		t.Errorf("Got %q want %q", fls, []string{path.Join(dir, "file1.txt")})
+	}
+	if _, e = FileList(path.Join(dir, "file1.txt")); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestGetFilesExtensions(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	content := []byte("temporary file's content")
+	for _, fn := range []string{"file1.txt", "file2.TXT", "file3.zip", "file4.exe", "file5"} {
+		if e = ioutil.WriteFile(path.Join(dir, fn), content, 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	tests := []struct {
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{nil, nil, []string{"file1.txt", "file2.TXT", "file3.zip", "file4.exe", "file5"}},
+		{[]string{".txt", "ZIP"}, nil, []string{"file1.txt", "file2.TXT", "file3.zip"}},
+		{nil, []string{".TXT", "exe"}, []string{"file3.zip", "file5"}},
+		{[]string{"txt", "zip"}, []string{"zip"}, []string{"file1.txt", "file2.TXT"}},
+		{[]string{""}, nil, []string{"file5"}},
+	}
+	for _, tt := range tests {
+		c.SetIncludeExtensions(tt.include)
+		c.SetExcludeExtensions(tt.exclude)
+		fls, e := getFiles(dir, c.listOpts)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		n := make([]string, len(fls))
+		for i, fn := range fls {
+			n[i] = filepath.Base(fn)
+		}
+		sort.Strings(n)
+		if strings.Join(n, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("include: %v exclude: %v got %v want %v", tt.include, tt.exclude, n, tt.expected)
+		}
+	}
+}
+
+func TestGetFilesSymlinks(t *testing.T) {
+	dir, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	if dir, e = filepath.EvalSymlinks(dir); e != nil {
+		t.Fatalf("Temp directory resolution failed")
+	}
+	target, e := ioutil.TempDir("", "")
+	if e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	defer os.RemoveAll(target)
+	if target, e = filepath.EvalSymlinks(target); e != nil {
+		t.Fatalf("Temp directory resolution failed")
+	}
+	content := []byte("temporary file's content")
+	fn := path.Join(dir, "file1.txt")
+	tfn := path.Join(target, "file2.txt")
+	tdfn := path.Join(target, "sub", "file3.txt")
+	if e = os.Mkdir(path.Join(target, "sub"), 0755); e != nil {
+		t.Fatalf("Temp directory creation failed")
+	}
+	for _, f := range []string{fn, tfn, tdfn} {
+		if e = ioutil.WriteFile(f, content, 0640); e != nil {
+			t.Fatalf("Temp file creation failed")
+		}
+	}
+	links := map[string]string{
+		// symlink to a file
+		path.Join(dir, "link1.txt"): tfn,
+		// symlink to a directory
+		path.Join(dir, "linkdir"): path.Join(target, "sub"),
+		// self referential loop
+		path.Join(dir, "loop"): dir,
+		// duplicate of a file already in the tree
+		path.Join(dir, "link2.txt"): fn,
+	}
+	for l, tg := range links {
+		if e = os.Symlink(tg, l); e != nil {
+			t.Fatalf("Symlink creation failed: %s", e)
+		}
+	}
+	fls, e := getFiles(dir, listOptions{})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(fls) != 1 || fls[0] != fn {
+		t.Errorf("Symlinks should be skipped by default got %v", fls)
+	}
+	fls, e = getFiles(dir, listOptions{followSymlinks: true})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	sort.Strings(fls)
+	expected := []string{fn, tfn, tdfn}
+	sort.Strings(expected)
+	if strings.Join(fls, ",") != strings.Join(expected, ",") {
+		t.Errorf("Got %v want %v", fls, expected)
+	}
+	c, e := NewClient("")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetFollowSymlinks(true)
+	if !c.listOpts.followSymlinks {
+		t.Errorf("Calling c.SetFollowSymlinks(%t) failed", true)
+	}
+}
+
+func TestScan(t *testing.T) {
+	address, dir, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	fn := path.Join(dir, "install.log")
+	s, e := c.ScanFile(ctx, fn)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	if len(s) != 1 {
+		t.Fatalf("Expected 1 got %d", len(s))
+	}
+	if s[0].Filename != fn {
+		t.Fatalf("Filename expected %s got %s", fn, s[0].Filename)
+	}
+	if s[0].Infected {
+		t.Fatalf("Infected expected %t got %t", false, s[0].Infected)
+	}
+	if s[0].Signature != "" {
+		t.Fatalf("Filename expected %s got %s", "", s[0].Signature)
+	}
+	fn = path.Join(dir, "eicar.txt")
+	s, e = c.ScanFile(ctx, fn)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	if len(s) != 1 {
+		t.Fatalf("Expected 1 got %d", len(s))
+	}
+	if s[0].Filename != fn {
+		t.Fatalf("Filename expected %s got %s", fn, s[0].Filename)
+	}
+	if !s[0].Infected {
+		t.Fatalf("Infected expected %t got %t", true, s[0].Infected)
+	}
+	if s[0].Signature != "EICAR_Test_File" {
+		t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", s[0].Signature)
+	}
+}
+
+func TestScanFiles(t *testing.T) {
+	address, dir, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	fns := []string{
+		path.Join(dir, "eicar.txt"),
+		path.Join(dir, "eicar.tar.bz2"),
+	}
+	s, e := c.ScanFiles(ctx, fns[0], fns[1])
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	if len(s) != len(fns) {
+		t.Fatalf("Expected %d got %d", len(fns), len(s))
+	}
+	for _, r := range s {
+		if r.Filename != fns[0] && r.Filename != fns[1] {
+			t.Fatalf("Filename expected %s or %s got %s", fns[0], fns[1], r.Filename)
+		}
+		if !r.Infected {
+			t.Fatalf("Infected expected %t got %t", true, r.Infected)
+		}
+		if r.Signature != "EICAR_Test_File" {
+			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+		}
+	}
+}
+
+func TestScanDir(t *testing.T) {
+	address, dir, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	s, e := c.ScanDir(ctx, dir)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	if len(s) == 0 {
+		t.Fatalf("Expected > 1 got %d", len(s))
+	}
+}
+
+func TestScanDirStream(t *testing.T) {
+	address, _, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	dn := path.Join("examples", "data")
+	s, e := c.ScanDirStream(ctx, dn)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	for _, r := range s {
+		if !r.Infected {
+			t.Fatalf("Infected expected %t got %t", true, r.Infected)
+		}
+		if r.Signature != "EICAR_Test_File" {
+			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+		}
+	}
+}
+
+func TestScanStream(t *testing.T) {
+	address, _, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	fn := path.Join("examples", "data", "eicar.tar.bz2")
+	s, e := c.ScanStream(ctx, fn)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	for _, r := range s {
+		if !r.Infected {
+			t.Fatalf("Infected expected %t got %t", true, r.Infected)
+		}
+		if r.Signature != "EICAR_Test_File" {
+			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+		}
+	}
+}
+
+func TestScanReader(t *testing.T) {
+	address, _, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	fn := path.Join("examples", "data", "eicar.tar.bz2")
+	f, e := os.Open(fn)
+	if e != nil {
+		t.Fatalf("Failed to open file: %s", fn)
+	}
+	defer f.Close()
+	s, e := c.ScanReader(ctx, f)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	for _, r := range s {
+		if !r.Infected {
+			t.Fatalf("Infected expected %t got %t", true, r.Infected)
+		}
+		if r.Signature != "EICAR_Test_File" {
+			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+		}
+	}
+}
+
+func TestScanReaderBytes(t *testing.T) {
+	address, _, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	m := []byte(eicarVirus)
+	f := bytes.NewReader(m)
+	s, e := c.ScanReader(ctx, f)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	for _, r := range s {
+		if !r.Infected {
+			t.Fatalf("Infected expected %t got %t", true, r.Infected)
+		}
+		if r.Signature != "EICAR_Test_File" {
+			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+		}
+	}
+}
+
+func TestScanReaderBuffer(t *testing.T) {
+	address, _, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	f := bytes.NewBufferString(eicarVirus)
+	s, e := c.ScanReader(ctx, f)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	for _, r := range s {
+		if !r.Infected {
+			t.Fatalf("Infected expected %t got %t", true, r.Infected)
+		}
+		if r.Signature != "EICAR_Test_File" {
+			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+		}
+	}
+}
+
+func TestScanReaderString(t *testing.T) {
+	address, _, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	f := strings.NewReader(eicarVirus)
+	s, e := c.ScanReader(ctx, f)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	for _, r := range s {
+		if !r.Infected {
+			t.Fatalf("Infected expected %t got %t", true, r.Infected)
+		}
+		if r.Signature != "EICAR_Test_File" {
+			t.Fatalf("Filename expected %s got %s", "EICAR_Test_File", r.Signature)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	address, _, stop := testFprotServer(t)
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer c.Close(ctx)
+	i, e := c.Info(ctx)
+	if e != nil {
+		t.Fatalf("Error should not be returned: %s", e)
+	}
+	if i.Engine == "" {
+		t.Errorf("i.Engine should be none empty string")
+	}
+	if i.Version == "" {
+		t.Errorf("i.Version should be none empty string")
+	}
+	if i.Protocol == "" {
+		t.Errorf("i.Protocol should be none empty string")
+	}
+	if i.Signature == "" {
+		t.Errorf("i.Signature should be none empty string")
+	}
+	if i.Uptime == "" {
+		t.Errorf("i.Uptime should be none empty string")
 	}
 }
@@ -0,0 +1,73 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fprot
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// An Option configures a Client created by NewClientWithOptions,
+// options apply the same validation as the matching setters
+type Option func(*Client)
+
+// WithConnTimeout sets the connection timeout
+func WithConnTimeout(t time.Duration) Option {
+	return func(c *Client) {
+		c.SetConnTimeout(t)
+	}
+}
+
+// WithCmdTimeout sets the cmd timeout
+func WithCmdTimeout(t time.Duration) Option {
+	return func(c *Client) {
+		c.SetCmdTimeout(t)
+	}
+}
+
+// WithConnRetries sets the number of times a failed
+// connection or command is retried
+func WithConnRetries(n int) Option {
+	return func(c *Client) {
+		c.SetConnRetries(n)
+	}
+}
+
+// WithDialer sets the dialer used to connect to the server
+func WithDialer(d ContextDialer) Option {
+	return func(c *Client) {
+		c.SetDialer(d)
+	}
+}
+
+// WithTLS sets the TLS configuration used to connect
+// to the server
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.SetTLSConfig(cfg)
+	}
+}
+
+// WithLogger sets the logger used to trace the protocol
+func WithLogger(l Logger) Option {
+	return func(c *Client) {
+		c.SetLogger(l)
+	}
+}
+
+// NewClientWithOptions creates and returns a new instance of
+// Client configured by opts, see NewClient for the address
+func NewClientWithOptions(address string, opts ...Option) (c *Client, err error) {
+	if c, err = NewClient(address); err != nil {
+		return
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return
+}
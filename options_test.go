@@ -0,0 +1,58 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package fprot Golang F-Prot client
+Fprot - Golang F-Prot client
+*/
+package fprot
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewClientWithOptions(t *testing.T) {
+	if _, e := NewClientWithOptions("fe80::879:d85f:f836:1b56%en1"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	cfg := &tls.Config{}
+	d := &net.Dialer{}
+	l := &testLogger{}
+	c, e := NewClientWithOptions("",
+		WithConnTimeout(2*time.Second),
+		WithCmdTimeout(3*time.Second),
+		WithConnRetries(2),
+		WithDialer(d),
+		WithTLS(cfg),
+		WithLogger(l),
+	)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.connTimeout != 2*time.Second {
+		t.Errorf("Got %s want %s", c.connTimeout, 2*time.Second)
+	}
+	if c.cmdTimeout != 3*time.Second {
+		t.Errorf("Got %s want %s", c.cmdTimeout, 3*time.Second)
+	}
+	if c.connRetries != 2 {
+		t.Errorf("Got %d want %d", c.connRetries, 2)
+	}
+	if c.dialer != d || c.tlsConfig != cfg || c.logger != l {
+		t.Errorf("The dialer, TLS config and logger should be set")
+	}
+	if c, e = NewClientWithOptions("", WithConnTimeout(-1), WithLogger(nil)); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.connTimeout != DefaultConnTimeout {
+		t.Errorf("An invalid timeout should be ignored")
+	}
+	if _, ok := c.logger.(nopLogger); !ok {
+		t.Errorf("A nil logger should set the no-op logger")
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fprot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	poolClosedErr = "The pool is closed"
+)
+
+// A Pool manages a bounded set of clients each with its own
+// connection to the server, allowing scans to run concurrently
+type Pool struct {
+	clients chan *Client
+	all     []*Client
+	out     map[*Client]bool
+	done    chan struct{}
+	closed  bool
+	m       sync.Mutex
+}
+
+// Get checks out a client from the pool waiting until one is
+// available, the client must be returned using Put. A connection
+// that the server closed while idle is reset so that the client
+// redials on the next command
+func (p *Pool) Get(ctx context.Context) (c *Client, err error) {
+	p.m.Lock()
+	closed := p.closed
+	p.m.Unlock()
+
+	if closed {
+		err = fmt.Errorf(poolClosedErr)
+		return
+	}
+
+	select {
+	case c = <-p.clients:
+	case <-p.done:
+		err = fmt.Errorf(poolClosedErr)
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	p.m.Lock()
+	if p.closed {
+		p.m.Unlock()
+		c.discard()
+		c, err = nil, fmt.Errorf(poolClosedErr)
+		return
+	}
+	p.out[c] = true
+	p.m.Unlock()
+
+	c.check()
+
+	return
+}
+
+// Put returns a client to the pool, a client whose connection
+// failed should be returned as well, its connection is reset
+// and it redials on the next command. Clients that are not
+// checked out from the pool are ignored
+func (p *Pool) Put(c *Client) {
+	p.m.Lock()
+	if !p.out[c] {
+		p.m.Unlock()
+		return
+	}
+	delete(p.out, c)
+	closed := p.closed
+	p.m.Unlock()
+
+	if closed {
+		c.discard()
+		return
+	}
+
+	// The channel holds every client so the send does not
+	// block, a client returned while the pool was closing
+	// is closed here
+	p.clients <- c
+
+	p.m.Lock()
+	closed = p.closed
+	p.m.Unlock()
+
+	if closed {
+		p.drain(context.Background())
+	}
+}
+
+// WithClient checks out a client, calls fn with it and returns
+// the client to the pool. The connection is reset if fn returns
+// an error other than a ScanError
+func (p *Pool) WithClient(ctx context.Context, fn func(*Client) error) (err error) {
+	var c *Client
+
+	if c, err = p.Get(ctx); err != nil {
+		return
+	}
+	defer p.Put(c)
+
+	if err = fn(c); err != nil {
+		if _, ok := err.(*ScanError); !ok {
+			c.discard()
+		}
+	}
+
+	return
+}
+
+// Close closes the connections of the idle clients in the pool,
+// clients that are checked out are closed when returned
+func (p *Pool) Close(ctx context.Context) (err error) {
+	p.m.Lock()
+
+	if p.closed {
+		p.m.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.m.Unlock()
+
+	err = p.drain(ctx)
+
+	return
+}
+
+// drain closes the clients that are in the pool
+func (p *Pool) drain(ctx context.Context) (err error) {
+	for {
+		select {
+		case c := <-p.clients:
+			if e := c.Close(ctx); e != nil && err == nil {
+				err = e
+			}
+		default:
+			return
+		}
+	}
+}
+
+// SetMaxConcurrency sets the maximum number of commands in
+// flight at once across all the clients in the pool, it must
+// be called before the pool is used
+func (p *Pool) SetMaxConcurrency(n int) {
+	var sem chan struct{}
+
+	if n > 0 {
+		sem = make(chan struct{}, n)
+	}
+
+	for _, c := range p.all {
+		c.sem = sem
+	}
+}
+
+// NewPool creates and returns a new Pool of size clients
+// connecting to address, the clients connect on first use
+func NewPool(address string, size int) (p *Pool, err error) {
+	var c *Client
+
+	if c, err = NewClient(address); err != nil {
+		return
+	}
+
+	p = NewPoolFromClient(c, size)
+
+	return
+}
+
+// NewPoolFromClient creates and returns a new Pool of size clones
+// of c, the settings of c such as the dialer, TLS configuration
+// and timeouts apply to the pooled clients
+func NewPoolFromClient(c *Client, size int) (p *Pool) {
+	if size < 1 {
+		size = 1
+	}
+
+	p = &Pool{
+		clients: make(chan *Client, size),
+		out:     make(map[*Client]bool, size),
+		done:    make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		pc := c.Clone()
+		p.all = append(p.all, pc)
+		p.clients <- pc
+	}
+
+	return
+}
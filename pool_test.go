@@ -0,0 +1,232 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package fprot Golang F-Prot client
+Fprot - Golang F-Prot client
+*/
+package fprot
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolBasics(t *testing.T) {
+	if _, e := NewPool("fe80::879:d85f:f836:1b56%en1", 2); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	p, e := NewPool("", 0)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if cap(p.clients) != 1 {
+		t.Errorf("Got %d want %d", cap(p.clients), 1)
+	}
+	ctx := context.Background()
+	c, e := p.Get(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.address != "127.0.0.1:10200" {
+		t.Errorf("Got %q want %q", c.address, "127.0.0.1:10200")
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, e = p.Get(tctx); e != context.DeadlineExceeded {
+		t.Errorf("Got %v want %v", e, context.DeadlineExceeded)
+	}
+	p.Put(c)
+	if e = p.Close(ctx); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if _, e = p.Get(ctx); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestPoolFromClient(t *testing.T) {
+	var conns int32
+	// The server closes each connection once it has been idle
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		atomic.AddInt32(&conns, 1)
+		if line, err := tc.ReadLine(); err != nil || line != "HELP" {
+			return
+		}
+		testWriteLine(tc, "%s", testBanner)
+		testWriteLine(tc, "")
+	})
+	defer stop()
+	c, e := NewClient(address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+	p := NewPoolFromClient(c, 1)
+	ctx := context.Background()
+	defer p.Close(ctx)
+	pc, e := p.Get(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if pc.cmdTimeout != 5*time.Second {
+		t.Errorf("Got %s want %s", pc.cmdTimeout, 5*time.Second)
+	}
+	if _, e = pc.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	p.Put(pc)
+	// Clients that are not checked out are not added
+	p.Put(pc)
+	p.Put(c)
+	if n := len(p.clients); n != 1 {
+		t.Errorf("Expected 1 client in the pool got %d", n)
+	}
+	time.Sleep(2 * aliveIdle)
+	if pc, e = p.Get(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer p.Put(pc)
+	if pc.tc != nil {
+		t.Errorf("The closed connection should be reset")
+	}
+	if _, e = pc.Info(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("Expected 2 connections got %d", n)
+	}
+}
+
+func TestPoolCloseWakesGet(t *testing.T) {
+	p, e := NewPool("", 1)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	c, e := p.Get(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Get(ctx)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.Close(ctx)
+	select {
+	case e = <-done:
+		if e == nil || e.Error() != poolClosedErr {
+			t.Errorf("Got %v want %s", e, poolClosedErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Get should return once the pool is closed")
+	}
+	p.Put(c)
+}
+
+func TestPoolWithClient(t *testing.T) {
+	address, stop := testServer(t, testScanHandler)
+	defer stop()
+	p, e := NewPool(address, 3)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	defer p.Close(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.WithClient(ctx, func(c *Client) error {
+				s, err := c.ScanReader(ctx, strings.NewReader(eicarVirus))
+				if err != nil {
+					return err
+				}
+				if len(s) != 1 || !s[0].Infected {
+					return errors.New("The stream should be infected")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("An error should not be returned: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	e = p.WithClient(ctx, func(c *Client) error {
+		if c.tc == nil {
+			t.Errorf("The pooled connection should be reused")
+		}
+		return errors.New("connection failure")
+	})
+	if e == nil {
+		t.Errorf("An error should be returned")
+	}
+	for i := 0; i < 3; i++ {
+		c, e := p.Get(ctx)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		defer p.Put(c)
+	}
+}
+
+func TestPoolMaxConcurrency(t *testing.T) {
+	var active, peak int32
+	address, stop := testServer(t, func(tc *textproto.Conn) {
+		for {
+			line, err := tc.ReadLine()
+			if err != nil || line != "HELP" {
+				return
+			}
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&peak)
+				if n <= m || atomic.CompareAndSwapInt32(&peak, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			testWriteLine(tc, "%s", testBanner)
+			testWriteLine(tc, "")
+		}
+	})
+	defer stop()
+	p, e := NewPool(address, 4)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	p.SetMaxConcurrency(1)
+	ctx := context.Background()
+	defer p.Close(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.WithClient(ctx, func(c *Client) error {
+				_, err := c.Info(ctx)
+				return err
+			})
+			if err != nil {
+				t.Errorf("An error should not be returned: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak != 1 {
+		t.Errorf("Expected at most 1 command in flight got %d", peak)
+	}
+}